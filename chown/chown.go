@@ -1,23 +1,43 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	drive "google.golang.org/api/drive/v2"
+	"google.golang.org/api/googleapi"
 
 	"github.com/ThomasHabets/drive-du/lib"
 )
 
 var (
-	srcconfig = flag.String("src_config", "", "Config file.")
-	dstconfig = flag.String("dst_config", "", "Config file.")
+	srcconfig = flag.String("src_config", "", "Config file of the source user.")
+	dstconfig = flag.String("dst_config", "", "Config file of the destination user.")
 	configure = flag.Bool("configure", false, "Configure oauth.")
 	workers   = flag.Int("workers", 10, "Number of Google API workers.")
-	folder    = flag.String("folder", "", "Folder.")
+	qps       = flag.Float64("qps", 0, "Most Google API requests per second, for both users and all workers together. 0 is unlimited.")
+	bwlimit   = flag.String("bwlimit", "", "Most bytes per second downloaded and uploaded, e.g. \"10M\". Empty is unlimited.")
+	srcFolder = flag.String("src", "", "Source folder ID, walked as the source user.")
+	dstFolder = flag.String("dst", "", "Destination folder ID, written to as the destination user.")
+	move      = flag.Bool("move", false, "Move files from -src to -dst within the source user's Drive, instead of to another user. Only -src_config is needed.")
+	owner     = flag.String("owner", notMe, "Only copy files owned by one of these comma separated emails. \""+notMe+"\" is anyone but the destination user, and empty is anyone.")
+	pathGlob  = flag.String("path", "", "Only copy files whose path matches this shell pattern, e.g. \"Photos/*.jpg\".")
+	mimeGlob  = flag.String("mimetype", "", "Only copy files whose MIME type matches this shell pattern, e.g. \"image/*\".")
+	transfer  = flag.String("transfer", "auto", "Transfer ownership with the Permissions API instead of copying: \"auto\" falls back to copying where that's not allowed, \"only\" never copies, and \"never\" always copies.")
+	srvCopy   = flag.Bool("server-copy", false, "Copy binary files with Files.Copy too, instead of downloading and uploading them. Google-native documents are always copied this way.")
+	retries   = flag.Int("retries", 3, "Number of times to copy a file again if the copy doesn't match the source.")
+	journFile = flag.String("journal", "", "Journal file. If set, an interrupted run can be resumed by running again with the same journal.")
+	shareOld  = flag.Bool("share-old-owner", false, "Share copies with the old owner as writer.")
+	chunkSize = flag.Int("chunk-size", 8, "Upload chunk size in MiB. Larger files are uploaded in chunks, and a chunk that fails is sent again instead of the whole file. 0 uploads files in one request.")
+	showBars  = flag.Bool("bars", false, "Show progress bars with speed and ETA on stderr, for every file being copied and overall.")
+	progEvery = flag.Duration("progress", 30*time.Second, "How often to log progress. 0 to only log it at the end.")
 )
 
 const (
@@ -26,51 +46,139 @@ const (
 	folderSeparator = "////!!////"
 )
 
+const (
+	idBatch         = 100
+	downloadRetries = 5                      // Times in a row to resume a failed download.
+	barEvery        = 500 * time.Millisecond // How often to redraw -bars.
+)
+
 var (
-	paths = make(map[string]string)
+	journ    = newJournal()
+	dstEmail string // Email of the destination user, who will own files.
+
+	idMutex sync.Mutex
+	freeIDs []string
+
+	dirLocksMutex sync.Mutex
+	dirLocks      = make(map[string]*sync.Mutex)
 )
 
-func findDir(d *drive.Service, p []string) string {
+// lockDir locks path p, so only one worker creates each folder.
+func lockDir(p []string) *sync.Mutex {
+	dirLocksMutex.Lock()
+	m, ok := dirLocks[pathKey(p)]
+	if !ok {
+		m = &sync.Mutex{}
+		dirLocks[pathKey(p)] = m
+	}
+	dirLocksMutex.Unlock()
+	m.Lock()
+	return m
+}
+
+// retry calls the Drive API with f until it succeeds, retrying rate limiting
+// and server errors with backoff.
+func retry(op string, f func() error) error {
+	return lib.Retry(context.Background(), op, f)
+}
+
+// newID returns an ID for a new file, fetching them from Drive in batches.
+func newID(d *drive.Service) (string, error) {
+	idMutex.Lock()
+	defer idMutex.Unlock()
+	if len(freeIDs) == 0 {
+		var ids *drive.GeneratedIds
+		if err := retry("Files.GenerateIds", func() error {
+			var err error
+			ids, err = d.Files.GenerateIds().MaxResults(idBatch).Space("drive").Do()
+			return err
+		}); err != nil {
+			return "", err
+		}
+		freeIDs = ids.Ids
+	}
+	if len(freeIDs) == 0 {
+		return "", fmt.Errorf("no IDs generated")
+	}
+	id := freeIDs[0]
+	freeIDs = freeIDs[1:]
+	return id, nil
+}
+
+// exists returns true if a file exists.
+func exists(d *drive.Service, id string) (bool, error) {
+	err := retry(fmt.Sprintf("Files.Get(%s)", id), func() error {
+		_, err := d.Files.Get(id).Fields("id").Do()
+		return err
+	})
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// findDir returns the ID of the destination folder for path p, creating it
+// and its parents if needed. It's safe to call from many workers.
+func findDir(d *drive.Service, p []string) (string, error) {
 	if len(p) == 0 {
-		return *folder
+		return *dstFolder, nil
+	}
+	id, done := journ.dir(p)
+	if done {
+		return id, nil
 	}
-	id, ok := paths[strings.Join(p, folderSeparator)]
-	if ok {
-		return id
+	// Another worker may have created it while we waited for the lock.
+	defer lockDir(p).Unlock()
+	if id, done = journ.dir(p); done {
+		return id, nil
 	}
 	up, this := p[:len(p)-1], p[len(p)-1]
-	upID := findDir(d, up)
-	thisFile, err := d.Files.Insert(&drive.File{
-		Title: this,
-		Parents: []*drive.ParentReference{
-			&drive.ParentReference{Id: upID},
-		},
-		MimeType: lib.DriveFolder,
-	}).Do()
+	upID, err := findDir(d, up)
 	if err != nil {
-		log.Fatal("mkdir(%q): %v", paths, err)
+		return "", err
+	}
+	if id == "" {
+		if id, err = newID(d); err != nil {
+			return "", err
+		}
+		if err := journ.record(&entry{Op: opMkdirStart, Path: p, Dst: id}); err != nil {
+			return "", err
+		}
+	} else if ok, err := exists(d, id); err != nil {
+		return "", err
+	} else if ok {
+		// Created before the last run was interrupted.
+		return id, journ.record(&entry{Op: opMkdir, Path: p, Dst: id})
 	}
-	paths[strings.Join(p, folderSeparator)] = thisFile.Id
-	return thisFile.Id
+	if err := retry(fmt.Sprintf("Files.Insert(%s)", id), func() error {
+		_, err := d.Files.Insert(&drive.File{
+			Id:    id,
+			Title: this,
+			Parents: []*drive.ParentReference{
+				&drive.ParentReference{Id: upID},
+			},
+			MimeType: lib.DriveFolder,
+		}).Do()
+		return err
+	}); err != nil {
+		return "", fmt.Errorf("mkdir(%q): %v", p, err)
+	}
+	return id, journ.record(&entry{Op: opMkdir, Path: p, Dst: id})
 }
 
-func copyFile(d *drive.Service, t *http.Client, p []string, f *drive.File) error {
+// copyFile downloads f with the source client srct and uploads it to folder
+// p under -dst, in chunks of -chunk-size. The copy gets ID id, or a new one
+// if id is empty.
+func copyFile(d *drive.Service, srct *http.Client, p []string, f *drive.File, id string) error {
 	if f.DownloadUrl == "" {
 		return fmt.Errorf("file is not downloadable")
 	}
-	req, err := http.NewRequest("GET", f.DownloadUrl, nil)
-	if err != nil {
-		return err
-	}
-	resp, err := t.Do(req)
-	defer resp.Body.Close()
+	dir, err := findDir(d, p)
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("downloading status: want 200, got %d: %v", resp.StatusCode)
-	}
 	fout := drive.File{
+		Id:               id,
 		Title:            f.Title,
 		Description:      f.Description,
 		MimeType:         f.MimeType,
@@ -79,20 +187,380 @@ func copyFile(d *drive.Service, t *http.Client, p []string, f *drive.File) error
 		Properties:       f.Properties,
 		Labels:           f.Labels,
 		Parents: []*drive.ParentReference{
-			&drive.ParentReference{Id: findDir(d, p)},
+			&drive.ParentReference{Id: dir},
 		},
 	}
-	_, err = d.Files.Insert(&fout).Media(resp.Body).Do()
+	// Each attempt downloads the file again from the start.
+	return retry(fmt.Sprintf("Files.Insert(%s)", id), func() error {
+		dl, err := openDownload(srct, f.DownloadUrl)
+		if err != nil {
+			return err
+		}
+		defer dl.Close()
+		r, done := prog.track(f, dl)
+		defer done()
+		_, err = d.Files.Insert(&fout).
+			Media(r, googleapi.ChunkSize(*chunkSize<<20), googleapi.ContentType(f.MimeType)).
+			Do()
+		return err
+	})
+}
+
+// serverCopy copies f to folder p under -dst with Files.Copy, without
+// downloading it. The copy gets ID id, or a new one if id is empty.
+func serverCopy(d *drive.Service, p []string, f *drive.File, id string) error {
+	dir, err := findDir(d, p)
 	if err != nil {
 		return err
 	}
+	return retry(fmt.Sprintf("Files.Copy(%s)", f.Id), func() error {
+		_, err := d.Files.Copy(f.Id, &drive.File{
+			Id:          id,
+			Title:       f.Title,
+			Description: f.Description,
+			Properties:  f.Properties,
+			Labels:      f.Labels,
+			Parents: []*drive.ParentReference{
+				&drive.ParentReference{Id: dir},
+			},
+		}).Do()
+		return err
+	})
+}
+
+// mismatchError is a copy that differs from its source.
+type mismatchError struct {
+	what     string
+	src, dst interface{}
+}
+
+func (e *mismatchError) Error() string {
+	return fmt.Sprintf("%s differs: source %v, copy %v", e.what, e.src, e.dst)
+}
+
+// verify checks that the copy dst has the same size and md5 as src.
+func verify(d *drive.Service, src *drive.File, dst string) error {
+	var f *drive.File
+	if err := retry(fmt.Sprintf("Files.Get(%s)", dst), func() error {
+		var err error
+		f, err = d.Files.Get(dst).Fields("id,fileSize,md5Checksum").Do()
+		return err
+	}); err != nil {
+		return err
+	}
+	if f.FileSize != src.FileSize {
+		return &mismatchError{"size", src.FileSize, f.FileSize}
+	}
+	if src.Md5Checksum != "" && f.Md5Checksum != src.Md5Checksum {
+		return &mismatchError{"md5", src.Md5Checksum, f.Md5Checksum}
+	}
+	return nil
+}
+
+// copyPermissions shares the copy dst like src is shared, except with the
+// old owner, who is only added as a writer with -share-old-owner, and the
+// destination user, who already owns it. Permissions that can't be added,
+// e.g. for users whose email isn't visible, are logged and skipped, since
+// trying again won't help.
+func copyPermissions(srcd, dstd *drive.Service, src *drive.File, dst string) error {
+	var l *drive.PermissionList
+	if err := retry(fmt.Sprintf("Permissions.List(%s)", src.Id), func() error {
+		var err error
+		l, err = srcd.Permissions.List(src.Id).Do()
+		return err
+	}); err != nil {
+		return err
+	}
+	for _, p := range l.Items {
+		if p.Deleted || strings.EqualFold(p.EmailAddress, dstEmail) {
+			continue
+		}
+		role := p.Role
+		if role == "owner" {
+			if !*shareOld {
+				continue
+			}
+			role = "writer"
+		}
+		n := &drive.Permission{
+			Type:            p.Type,
+			Role:            role,
+			AdditionalRoles: p.AdditionalRoles,
+			WithLink:        p.WithLink,
+			Value:           p.EmailAddress,
+		}
+		switch p.Type {
+		case "domain":
+			n.Value = p.Domain
+		case "user", "group":
+			if p.EmailAddress == "" {
+				log.Printf("Not sharing copy %s of %q with %s %q, who has no visible email", dst, src.Title, p.Type, p.Name)
+				continue
+			}
+		}
+		if err := retry(fmt.Sprintf("Permissions.Insert(%s)", dst), func() error {
+			_, err := dstd.Permissions.Insert(dst, n).SendNotificationEmails(false).Do()
+			return err
+		}); err != nil {
+			log.Printf("Not sharing copy %s of %q with %s %s%s: %v", dst, src.Title, p.Type, p.EmailAddress, p.Domain, err)
+		}
+	}
 	return nil
 }
 
+// copyMetadata sets the modifiedDate and starred label of the copy dst to
+// those of src, and shares it like src. Other metadata, including
+// properties private to apps, is set when copying.
+func copyMetadata(srcd, dstd *drive.Service, src *drive.File, dst string) error {
+	f := &drive.File{ModifiedDate: src.ModifiedDate}
+	if src.Labels != nil && src.Labels.Starred {
+		f.Labels = &drive.FileLabels{Starred: true}
+	}
+	if err := retry(fmt.Sprintf("Files.Patch(%s)", dst), func() error {
+		_, err := dstd.Files.Patch(dst, f).SetModifiedDate(src.ModifiedDate != "").Fields("id").Do()
+		return err
+	}); err != nil {
+		return err
+	}
+	return copyPermissions(srcd, dstd, src, dst)
+}
+
+// errNotAllowed is returned by transferOwner when a transfer is refused.
+var errNotAllowed = errors.New("ownership transfer not allowed")
+
+// refusals are the error reasons Drive gives when it doesn't allow
+// transferring ownership to the destination user. They're true if it's the
+// domain policy, which refuses all files alike, and false if it's just this
+// file.
+var refusals = map[string]bool{
+	"ownershipChangeAcrossDomainNotPermitted": true,
+	"consentRequiredForOwnershipTransfer":     true,
+	"domainPolicy":                            true,
+	"invalidSharingRequest":                   false,
+}
+
+var (
+	refusedMutex sync.Mutex
+	refused      bool // The domain policy refused a transfer, so it'll refuse all.
+)
+
+// ownedBySource returns true if the source user, who listed f, owns it. Only
+// the owner can transfer ownership.
+func ownedBySource(f *drive.File) bool {
+	for _, o := range f.Owners {
+		if o.IsAuthenticatedUser {
+			return true
+		}
+	}
+	return false
+}
+
+// transferOwner makes dstEmail the owner of f, using the source user's
+// credentials. It returns errNotAllowed if Drive refuses, e.g. because the
+// users are in different domains. If it's the domain policy, it doesn't ask
+// again for the rest of the run.
+func transferOwner(srcd *drive.Service, f *drive.File) error {
+	refusedMutex.Lock()
+	r := refused
+	refusedMutex.Unlock()
+	if r {
+		return errNotAllowed
+	}
+	err := retry(fmt.Sprintf("Permissions.Insert(%s)", f.Id), func() error {
+		_, err := srcd.Permissions.Insert(f.Id, &drive.Permission{
+			Type:  "user",
+			Role:  "owner",
+			Value: dstEmail,
+		}).SendNotificationEmails(false).Do()
+		return err
+	})
+	e, ok := err.(*googleapi.Error)
+	if !ok || (e.Code != http.StatusBadRequest && e.Code != http.StatusForbidden) {
+		return err
+	}
+	for _, r := range e.Errors {
+		policy, ok := refusals[r.Reason]
+		if !ok {
+			continue
+		}
+		if policy {
+			refusedMutex.Lock()
+			if !refused {
+				log.Printf("Ownership transfer to %s refused by domain policy, not trying again: %v", dstEmail, err)
+			}
+			refused = true
+			refusedMutex.Unlock()
+		}
+		return errNotAllowed
+	}
+	return err
+}
+
+// inside returns true if folder id is folder dir, or anywhere under it.
+func inside(d *drive.Service, id, dir string) (bool, error) {
+	seen := map[string]bool{id: true}
+	todo := []string{id}
+	for len(todo) > 0 {
+		id, todo = todo[0], todo[1:]
+		if id == dir {
+			return true, nil
+		}
+		var f *drive.File
+		if err := retry(fmt.Sprintf("Files.Get(%s)", id), func() error {
+			var err error
+			f, err = d.Files.Get(id).Fields("parents(id)").Do()
+			return err
+		}); err != nil {
+			return false, err
+		}
+		for _, p := range f.Parents {
+			if !seen[p.Id] {
+				seen[p.Id] = true
+				todo = append(todo, p.Id)
+			}
+		}
+	}
+	return false, nil
+}
+
+// trash moves a file to the trash.
+func trash(d *drive.Service, id string) error {
+	return retry(fmt.Sprintf("Files.Trash(%s)", id), func() error {
+		_, err := d.Files.Trash(id).Do()
+		return err
+	})
+}
+
+// moveFile moves a file to the same path under -dst, out of all its current
+// folders, like find -move-to.
+func moveFile(d *drive.Service, e *lib.File) error {
+	dir, err := findDir(d, e.Path)
+	if err != nil {
+		return err
+	}
+	var old []string
+	for _, p := range e.File.Parents {
+		if p.Id != dir {
+			old = append(old, p.Id)
+		}
+	}
+	log.Printf("Moving %q", e.File.Title)
+	if err := retry(fmt.Sprintf("Files.Patch(%s)", e.File.Id), func() error {
+		_, err := d.Files.Patch(e.File.Id, &drive.File{}).
+			AddParents(dir).
+			RemoveParents(strings.Join(old, ",")).
+			Fields("id").
+			Do()
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to move %q (%s): %v", e.File.Title, e.File.Id, err)
+	}
+	return journ.record(&entry{Op: opMove, Src: e.File.Id})
+}
+
+// migrate moves a file with -move. Otherwise it transfers ownership of the
+// file if allowed and moves it to -dst, and otherwise copies it unless the journal says it's
+// already copied, and trashes the source once the copy is verified. Copies
+// that don't match the source are trashed and copied again, up to -retries
+// times.
+func migrate(srcd, dstd *drive.Service, srct *http.Client, e *lib.File) error {
+	if *move {
+		return moveFile(srcd, e)
+	}
+	dst, done := journ.copy(e.File.Id)
+	// A transfer keeps the file ID, links and comments, but isn't tried
+	// if copying already started, or for files of other users.
+	if *transfer != "never" && dst == "" {
+		err := errNotAllowed
+		if ownedBySource(e.File) {
+			err = transferOwner(srcd, e.File)
+		}
+		if err == nil {
+			log.Printf("Transferred ownership of %q (%s)", e.File.Title, e.File.Id)
+			// The destination user owns it now, so moves it. If
+			// interrupted before it's recorded, the transfer is
+			// harmlessly done again.
+			if err := moveFile(dstd, e); err != nil {
+				return err
+			}
+			return journ.record(&entry{Op: opTransfer, Src: e.File.Id})
+		}
+		if err != errNotAllowed || *transfer == "only" {
+			return fmt.Errorf("failed to transfer ownership of %q (%s): %v", e.File.Title, e.File.Id, err)
+		}
+		log.Printf("Not allowed to transfer ownership of %q (%s), copying instead", e.File.Title, e.File.Id)
+	}
+	exist := done
+	if !done && dst != "" {
+		// Copying was interrupted. Drive only creates the file when
+		// the last chunk of a resumable upload arrives, and single
+		// request uploads and server copies are atomic, so the copy is
+		// complete if it exists at all. It's verified below anyway.
+		ok, err := exists(dstd, dst)
+		if err != nil {
+			return fmt.Errorf("checking for copy %s of %q (%s): %v", dst, e.File.Title, e.File.Id, err)
+		}
+		exist = ok
+	}
+	for attempt := 0; ; attempt++ {
+		if !exist {
+			if dst == "" {
+				var err error
+				if dst, err = newID(dstd); err != nil {
+					return err
+				}
+				if err := journ.record(&entry{Op: opCopyStart, Src: e.File.Id, Dst: dst}); err != nil {
+					return err
+				}
+			}
+			log.Printf("Copying %q", e.File.Title)
+			var err error
+			if *srvCopy || lib.IsNative(e.File) {
+				err = serverCopy(dstd, e.Path, e.File, dst)
+			} else {
+				err = copyFile(dstd, srct, e.Path, e.File, dst)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to copy %q (%s): %v", e.File.Title, e.File.Id, err)
+			}
+		}
+		err := verify(dstd, e.File, dst)
+		if err == nil {
+			break
+		}
+		if _, ok := err.(*mismatchError); !ok {
+			return fmt.Errorf("failed to verify copy %s of %q (%s): %v", dst, e.File.Title, e.File.Id, err)
+		}
+		if attempt >= *retries {
+			return fmt.Errorf("copy %s of %q (%s) is bad after %d attempts, not trashing source: %v", dst, e.File.Title, e.File.Id, attempt+1, err)
+		}
+		log.Printf("Copy %s of %q (%s) is bad, copying again: %v", dst, e.File.Title, e.File.Id, err)
+		if err := trash(dstd, dst); err != nil {
+			return fmt.Errorf("failed to trash bad copy %s of %q (%s): %v", dst, e.File.Title, e.File.Id, err)
+		}
+		dst, exist, done = "", false, false
+	}
+	if !done {
+		// Done again if interrupted before the copy is recorded, which
+		// is harmless since sharing twice changes nothing.
+		if err := copyMetadata(srcd, dstd, e.File, dst); err != nil {
+			return fmt.Errorf("failed to copy metadata to %s of %q (%s): %v", dst, e.File.Title, e.File.Id, err)
+		}
+		if err := journ.record(&entry{Op: opCopy, Src: e.File.Id, Dst: dst}); err != nil {
+			return err
+		}
+	}
+	log.Printf("Trashing %s in source user", e.File.Id)
+	if err := trash(srcd, e.File.Id); err != nil {
+		return fmt.Errorf("failed to trash %q (%s): %v", e.File.Title, e.File.Id, err)
+	}
+	return journ.record(&entry{Op: opTrash, Src: e.File.Id})
+}
+
 func main() {
 	flag.Parse()
-	if *srcconfig == "" || *dstconfig == "" {
-		log.Fatalf("-srcconfig and -dstconfig required")
+	if *srcconfig == "" || (*dstconfig == "" && !*move) {
+		log.Fatalf("-src_config and -dst_config required, or only -src_config with -move")
 	}
 
 	if *configure {
@@ -100,60 +568,99 @@ func main() {
 		if err := lib.ConfigureWrite(scope, accessType, *srcconfig); err != nil {
 			log.Fatal(err)
 		}
+		if *move {
+			return
+		}
 		fmt.Printf("------------ Destination user ---------------\n")
 		if err := lib.ConfigureWrite(scope, accessType, *dstconfig); err != nil {
 			log.Fatal(err)
 		}
 		return
 	}
+	if *srcFolder == "" || *dstFolder == "" {
+		log.Fatalf("-src and -dst required")
+	}
+	if *srcFolder == *dstFolder {
+		log.Fatalf("-src and -dst must be different folders")
+	}
+	switch *transfer {
+	case "auto", "only", "never":
+	default:
+		log.Fatalf("-transfer must be auto, only or never, not %q", *transfer)
+	}
+	if *move {
+		// All files are the source user's to move, whoever owns them.
+		ownerSet := false
+		flag.Visit(func(f *flag.Flag) { ownerSet = ownerSet || f.Name == "owner" })
+		if !ownerSet {
+			*owner = ""
+		}
+	}
 
 	srcconf, err := lib.ReadConfig(*srcconfig)
 	if err != nil {
 		log.Fatal(err)
 	}
-	dstconf, err := lib.ReadConfig(*dstconfig)
+	// The limits are shared by both users, since they count against
+	// the same API project.
+	limits, err := lib.ParseLimits(*qps, *bwlimit)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("-bwlimit: %v", err)
 	}
-
 	srct, err := lib.Connect(srcconf.OAuth, scope, accessType)
 	if err != nil {
 		log.Fatal(err)
 	}
-	dstt, err := lib.Connect(dstconf.OAuth, scope, accessType)
+	srct = limits.Client(srct)
+	srcd, err := drive.New(srct)
 	if err != nil {
 		log.Fatal(err)
 	}
-	srcd, err := drive.New(srct)
+	dstd := srcd
+	if *move {
+		// Otherwise the walk would find moved files again, and move them
+		// again.
+		in, err := inside(srcd, *dstFolder, *srcFolder)
+		if err != nil {
+			log.Fatalf("Checking -dst: %v", err)
+		}
+		if in {
+			log.Fatalf("-dst must not be inside -src with -move")
+		}
+	} else {
+		dstconf, err := lib.ReadConfig(*dstconfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dstt, err := lib.Connect(dstconf.OAuth, scope, accessType)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if dstd, err = drive.New(limits.Client(dstt)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	about, err := dstd.About.Get().Fields("user").Do()
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("Getting destination user: %v", err)
 	}
-	dstd, err := drive.New(dstt)
+	dstEmail = about.User.EmailAddress
+	sel, err := newFilter(*owner, dstEmail, *pathGlob, *mimeGlob)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if journ, err = openJournal(*journFile); err != nil {
+		log.Fatal(err)
+	}
+	defer journ.Close()
+
 	//lib.Verbose = true
 	ch := make(chan *lib.File)
-	go lib.ListRecursive(dstd, *workers, ch, *folder)
+	go lib.ListRecursive(srcd, *workers, ch, *srcFolder)
 
-	seen := make(map[string]bool)
-	for e := range ch {
-		if seen[e.File.Id] {
-			continue
-		}
-		seen[e.File.Id] = true
-		log.Printf("%q %q", e.File.Title, e.File.OwnerNames)
-		if e.File.OwnerNames[0] != "Insecure User" {
-			continue
-		}
-		log.Printf("Copying %q", e.File.Title)
-		if err := copyFile(dstd, dstt, e.Path, e.File); err != nil {
-			log.Fatalf("Failed to download %q (%s): %v", e.File.Title, e.File.Id, err)
-		}
-		log.Printf("Trashing %s in source user", e.File.Id)
-		if _, err := srcd.Files.Trash(e.File.Id).Do(); err != nil {
-			log.Fatalf("Failed to trash %q (%s): %v", e.File.Title, e.File.Id, err)
-		}
+	if failed := migrateAll(srcd, dstd, srct, ch, sel, *workers); failed > 0 {
+		log.Fatalf("%d files failed, and were left in the source", failed)
 	}
 }
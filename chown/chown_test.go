@@ -1,8 +1,646 @@
 package main
 
 import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/ThomasHabets/drive-du/lib"
+	"github.com/ThomasHabets/drive-du/lib/drivefake"
 )
 
-func TestBuilds(t *testing.T) {
+// setup returns a fake Drive with the folders src and dst, and its service,
+// with flags set to copy files to dst. Every flag and global the tests
+// change is restored when the test is done.
+func setup(t *testing.T) (*drivefake.Server, *drive.Service) {
+	t.Helper()
+	oldDst, oldTransfer, oldRetries, oldSrvCopy := *dstFolder, *transfer, *retries, *srvCopy
+	oldShareOld, oldMove, oldChunkSize, oldProgEvery := *shareOld, *move, *chunkSize, *progEvery
+	oldJourn, oldDstEmail, oldRefused, oldIDs := journ, dstEmail, refused, freeIDs
+	t.Cleanup(func() {
+		*dstFolder, *transfer, *retries, *srvCopy = oldDst, oldTransfer, oldRetries, oldSrvCopy
+		*shareOld, *move, *chunkSize, *progEvery = oldShareOld, oldMove, oldChunkSize, oldProgEvery
+		journ, dstEmail, refused, freeIDs = oldJourn, oldDstEmail, oldRefused, oldIDs
+	})
+
+	s := drivefake.New()
+	t.Cleanup(s.Close)
+	s.AddFolder("src", "src")
+	s.AddFolder("dst", "dst")
+	*dstFolder = "dst"
+	*transfer = "never"
+	*progEvery = 0
+	journ = newJournal()
+	dstEmail = drivefake.Me
+	refused = false
+	// IDs are only valid in the fake that generated them.
+	freeIDs = nil
+	return s, s.Service()
+}
+
+func TestCopyFile(t *testing.T) {
+	s, d := setup(t)
+	src := s.AddFile("f", "f.txt", "file content", "src")
+
+	if err := copyFile(d, s.Client(), []string{"a", "b"}, src, ""); err != nil {
+		t.Fatal(err)
+	}
+	a := s.Children("dst")
+	if len(a) != 1 {
+		t.Fatalf("dst: got %d children, want 1", len(a))
+	}
+	b := s.Children(a[0])
+	if len(b) != 1 {
+		t.Fatalf("dst/a: got %d children, want 1", len(b))
+	}
+	files := s.Children(b[0])
+	if len(files) != 1 {
+		t.Fatalf("dst/a/b: got %d children, want 1", len(files))
+	}
+	if got, want := s.File(files[0]).Title, "f.txt"; got != want {
+		t.Errorf("title: got %q, want %q", got, want)
+	}
+	if got, want := string(s.Content(files[0])), "file content"; got != want {
+		t.Errorf("content: got %q, want %q", got, want)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	me := &drive.User{EmailAddress: "Me@example.com"}
+	x := &drive.User{EmailAddress: "X@example.com"}
+	y := &drive.User{EmailAddress: "y@example.com"}
+	files := []*lib.File{
+		{Path: []string{"Photos"}, File: &drive.File{Title: "a.jpg", MimeType: "image/jpeg", Owners: []*drive.User{x}}},
+		{Path: []string{"Photos", "2019"}, File: &drive.File{Title: "b.jpg", MimeType: "image/jpeg", Owners: []*drive.User{y}}},
+		{File: &drive.File{Title: "c.txt", MimeType: "text/plain", Owners: []*drive.User{me}}},
+		{File: &drive.File{Title: "d.txt", MimeType: "text/plain", Owners: []*drive.User{me, y}}},
+	}
+	for _, test := range []struct {
+		owner, path, mime string
+		want              string
+	}{
+		{"", "", "", "a.jpg,b.jpg,c.txt,d.txt"},
+		{"notme", "", "", "a.jpg,b.jpg"},
+		{"x@example.com", "", "", "a.jpg"},
+		{"x@example.com, Y@example.com", "", "", "a.jpg,b.jpg,d.txt"},
+		{"notme,me@example.com", "", "", "a.jpg,b.jpg,c.txt,d.txt"},
+		{"", "Photos/*", "", "a.jpg"},
+		{"", "*/*/*.jpg", "", "b.jpg"},
+		{"", "", "text/*", "c.txt,d.txt"},
+		{"y@example.com", "", "text/*", "d.txt"},
+	} {
+		f, err := newFilter(test.owner, "me@example.com", test.path, test.mime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range files {
+			if f.match(e) {
+				got = append(got, e.File.Title)
+			}
+		}
+		if strings.Join(got, ",") != test.want {
+			t.Errorf("newFilter(%q, %q, %q): got %q, want %q", test.owner, test.path, test.mime, got, test.want)
+		}
+	}
+	if _, err := newFilter("", "", "[", ""); err == nil {
+		t.Errorf("want error for bad pattern")
+	}
+}
+
+func TestMigrateResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chown-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "journal")
+
+	s, d := setup(t)
+	f1 := s.AddFile("f1", "f1", "1", "src")
+	f2 := s.AddFile("f2", "f2", "2", "src")
+	f3 := s.AddFile("f3", "f3", "3", "src")
+
+	// A run was interrupted: folder a was about to be created, f1 was
+	// copied to c1 but not trashed, f2 was done, and the last line is
+	// partly written.
+	s.AddFile("c1", "f1", "1", "dst")
+	if err := ioutil.WriteFile(fn, []byte(`{"op":"mkdir-start","path":["a"],"dst":"new-a"}
+{"op":"copy-start","src":"f1","dst":"c1"}
+{"op":"copy-start","src":"f2","dst":"c2"}
+{"op":"copy","src":"f2","dst":"c2"}
+{"op":"trash","src":"f2"}
+{"op":"tra`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if journ, err = openJournal(fn); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []*drive.File{f1, f2, f3} {
+		if journ.isDone(f.Id) {
+			continue
+		}
+		if err := migrate(d, d, s.Client(), &lib.File{Path: []string{"a"}, File: f}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := journ.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := strings.Join(s.Children("dst"), ","), "c1,new-a"; got != want {
+		t.Errorf("dst: got %q, want %q", got, want)
+	}
+	a := s.Children("new-a")
+	if len(a) != 1 || s.File(a[0]).Title != "f3" {
+		t.Errorf("dst/a: got %q, want only f3", a)
+	}
+	for _, id := range []string{"f1", "f3"} {
+		if !s.File(id).Labels.Trashed {
+			t.Errorf("%s not trashed", id)
+		}
+	}
+	if s.File("f2").Labels.Trashed {
+		t.Errorf("f2 trashed again")
+	}
+
+	// Everything is recorded, so nothing is done again.
+	if journ, err = openJournal(fn); err != nil {
+		t.Fatal(err)
+	}
+	defer journ.Close()
+	for _, id := range []string{"f1", "f2", "f3"} {
+		if !journ.isDone(id) {
+			t.Errorf("%s: not trashed in journal", id)
+		}
+	}
+	if id, done := journ.dir([]string{"a"}); id != "new-a" || !done {
+		t.Errorf("dir a: got %q %v, want %q true", id, done, "new-a")
+	}
+}
+
+// truncate cuts the first n downloads short.
+type truncate struct {
+	rt http.RoundTripper
+	n  int
+}
+
+func (t *truncate) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := t.rt.RoundTrip(r)
+	if err != nil || r.URL.Query().Get("alt") != "media" || t.n == 0 {
+		return resp, err
+	}
+	t.n--
+	resp.Body = ioutil.NopCloser(io.LimitReader(resp.Body, 1))
+	return resp, nil
+}
+
+func TestMigrateVerify(t *testing.T) {
+	s, d := setup(t)
+	good := s.AddFile("good", "good", "good content", "src")
+	bad := s.File(s.AddFile("bad", "bad", "bad content", "src").Id)
+	bad.Md5Checksum = "not the md5"
+	*retries = 2
+
+	// The first copy is truncated, the second is fine.
+	c := &http.Client{Transport: &truncate{rt: s.Client().Transport, n: 1}}
+	if err := migrate(d, d, c, &lib.File{File: good}); err != nil {
+		t.Fatal(err)
+	}
+	if !s.File("good").Labels.Trashed {
+		t.Errorf("source not trashed after good copy")
+	}
+	var copies, trashed int
+	for _, id := range s.Children("dst") {
+		copies++
+		if s.File(id).Labels.Trashed {
+			trashed++
+		}
+	}
+	if copies != 2 || trashed != 1 {
+		t.Errorf("got %d copies with %d trashed, want 2 with 1 trashed", copies, trashed)
+	}
+
+	// Every copy of bad differs from its md5.
+	if err := migrate(d, d, s.Client(), &lib.File{File: bad}); err == nil {
+		t.Errorf("want error for bad copy")
+	}
+	if s.File("bad").Labels.Trashed {
+		t.Errorf("source trashed after bad copy")
+	}
+	if got, want := len(s.Children("dst")), 5; got != want {
+		t.Errorf("got %d copies, want %d", got, want)
+	}
+	if journ.isDone("bad") {
+		t.Errorf("bad source recorded as trashed")
+	}
+}
+
+func TestMigrateServerCopy(t *testing.T) {
+	s, d := setup(t)
+	doc := s.Add(&drive.File{
+		Id:          "doc",
+		Title:       "doc",
+		MimeType:    "application/vnd.google-apps.document",
+		Description: "desc",
+		Properties:  []*drive.Property{{Key: "k", Value: "v"}},
+		Parents:     []*drive.ParentReference{{Id: "src"}},
+	}, nil)
+	bin := s.AddFile("bin", "bin", "content", "src")
+
+	for _, test := range []struct {
+		srv   bool
+		f     *drive.File
+		calls int // Files.Copy calls so far.
+	}{
+		{false, doc, 1},
+		{false, bin, 1},
+		{true, bin, 2},
+	} {
+		*srvCopy = test.srv
+		journ = newJournal()
+		if err := migrate(d, d, s.Client(), &lib.File{Path: []string{"a"}, File: test.f}); err != nil {
+			t.Fatal(err)
+		}
+		if got := s.Calls("Files.Copy"); got != test.calls {
+			t.Errorf("%s, -server-copy=%v: got %d Files.Copy calls, want %d", test.f.Id, test.srv, got, test.calls)
+		}
+		if test.f == doc {
+			id, _ := journ.copy("doc")
+			c := s.File(id)
+			if c.Title != "doc" || c.Description != "desc" || len(c.Properties) != 1 || c.Properties[0].Value != "v" {
+				t.Errorf("doc copy: got %+v", c)
+			}
+		}
+	}
+
+	id, _ := journ.copy("bin")
+	if got, want := string(s.Content(id)), "content"; got != want {
+		t.Errorf("content: got %q, want %q", got, want)
+	}
+}
+
+func TestMigrateRetry(t *testing.T) {
+	s, d := setup(t)
+	s.AddFile("f", "f", "content", "src")
+
+	// Rate limiting and server errors are retried, not failures.
+	for _, op := range []string{"Files.Insert", "Files.Patch", "Permissions.List", "Files.Trash"} {
+		s.Inject(drivefake.Fault{Op: op, Code: 403, Reason: "userRateLimitExceeded", Times: 1})
+	}
+	if err := migrate(d, d, s.Client(), &lib.File{Path: []string{"a"}, File: s.File("f")}); err != nil {
+		t.Fatal(err)
+	}
+	if !s.File("f").Labels.Trashed {
+		t.Errorf("source not trashed")
+	}
+	id, _ := journ.copy("f")
+	if got, want := string(s.Content(id)), "content"; got != want {
+		t.Errorf("content: got %q, want %q", got, want)
+	}
+}
+
+func TestMigrateTransfer(t *testing.T) {
+	s, d := setup(t)
+	old := []*drive.User{{EmailAddress: "old@example.com", IsAuthenticatedUser: true}}
+	other := []*drive.User{{EmailAddress: "other@example.com"}}
+	for _, id := range []string{"f1", "f2", "f3", "f4", "f5", "f6"} {
+		owners := old
+		if id == "f2" {
+			owners = other
+		}
+		s.Add(&drive.File{Id: id, Title: id, Owners: owners, Parents: []*drive.ParentReference{{Id: "src"}}}, []byte(id))
+	}
+	*transfer = "auto"
+	transferred := func(id string) {
+		t.Helper()
+		if err := migrate(d, d, s.Client(), &lib.File{File: s.File(id)}); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := s.File(id).Owners[0].EmailAddress, drivefake.Me; got != want {
+			t.Errorf("%s owner: got %q, want %q", id, got, want)
+		}
+		if s.File(id).Labels.Trashed || !journ.isDone(id) {
+			t.Errorf("%s trashed or not done", id)
+		}
+		if _, copied := journ.copy(id); copied {
+			t.Errorf("%s copied", id)
+		}
+		if got := s.File(id).Parents; len(got) != 1 || got[0].Id != "dst" {
+			t.Errorf("%s parents: got %+v, want only dst", id, got)
+		}
+	}
+	copied := func(id string) {
+		t.Helper()
+		if err := migrate(d, d, s.Client(), &lib.File{File: s.File(id)}); err != nil {
+			t.Fatal(err)
+		}
+		if !s.File(id).Labels.Trashed {
+			t.Errorf("%s not trashed after copy", id)
+		}
+		if dst, done := journ.copy(id); dst == "" || !done {
+			t.Errorf("%s not copied", id)
+		}
+	}
+
+	// Allowed, after being rate limited.
+	s.Inject(drivefake.Fault{Op: "Permissions.Insert", Code: 403, Reason: "userRateLimitExceeded", Times: 1})
+	transferred("f1")
+
+	// Owned by someone else, so not even tried.
+	calls := s.Calls("Permissions.Insert")
+	copied("f2")
+	if got := s.Calls("Permissions.Insert"); got != calls {
+		t.Errorf("transfer of another user's file tried")
+	}
+
+	// Not allowed for this file, but still tried for others.
+	s.Inject(drivefake.Fault{Op: "Permissions.Insert", Code: 400, Reason: "invalidSharingRequest", Times: 1})
+	copied("f3")
+	transferred("f4")
+
+	// Not allowed by the domain policy, so copied.
+	s.Inject(drivefake.Fault{Op: "Permissions.Insert", Code: 403, Reason: "ownershipChangeAcrossDomainNotPermitted", Times: -1})
+	copied("f5")
+
+	// Not allowed, and copying isn't either. It's not even tried again.
+	*transfer = "only"
+	calls = s.Calls("Permissions.Insert")
+	if err := migrate(d, d, s.Client(), &lib.File{File: s.File("f6")}); err == nil {
+		t.Errorf("want error when transfer isn't allowed")
+	}
+	if got := s.Calls("Permissions.Insert"); got != calls {
+		t.Errorf("transfer tried again after being refused")
+	}
+	if s.File("f6").Labels.Trashed || journ.isDone("f6") {
+		t.Errorf("f6 trashed or done")
+	}
+}
+
+func TestMigrateAll(t *testing.T) {
+	s, d := setup(t)
+	sel, err := newFilter("", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 20
+	ch := make(chan *lib.File, n+1)
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("f%d", i)
+		ch <- &lib.File{Path: []string{"a", "b"}, File: s.AddFile(id, id, id, "src")}
+	}
+	// Seen before in another folder.
+	ch <- &lib.File{Path: []string{"c"}, File: s.File("f0")}
+	close(ch)
+	if failed := migrateAll(d, d, s.Client(), ch, sel, 8); failed != 0 {
+		t.Fatalf("%d failed", failed)
+	}
+
+	// Every worker needed a/b, but each folder is only created once.
+	a := s.Children("dst")
+	if len(a) != 1 {
+		t.Fatalf("dst: got %d children, want 1", len(a))
+	}
+	b := s.Children(a[0])
+	if len(b) != 1 {
+		t.Fatalf("dst/a: got %d children, want 1", len(b))
+	}
+	if got := len(s.Children(b[0])); got != n {
+		t.Errorf("dst/a/b: got %d children, want %d", got, n)
+	}
+	for i := 0; i < n; i++ {
+		if id := fmt.Sprintf("f%d", i); !journ.isDone(id) || !s.File(id).Labels.Trashed {
+			t.Errorf("%s not done", id)
+		}
+	}
+}
+
+func TestMigratePermissions(t *testing.T) {
+	s, d := setup(t)
+	const date = "2001-02-03T04:05:06.000Z"
+	s.Add(&drive.File{
+		Id:           "f",
+		Title:        "f",
+		ModifiedDate: date,
+		Labels:       &drive.FileLabels{Starred: true},
+		Owners:       []*drive.User{{EmailAddress: "old@example.com"}},
+		Parents:      []*drive.ParentReference{{Id: "src"}},
+	}, []byte("content"))
+	s.AddPermission("f", "user", "reader", "a@example.com")
+	s.AddPermission("f", "group", "writer", "g@example.com")
+	s.AddPermission("f", "domain", "reader", "example.com")
+	s.AddPermission("f", "user", "writer", drivefake.Me)
+	s.AddPermission("f", "user", "reader", "") // Email not visible.
+
+	for _, test := range []struct {
+		shareOld bool
+		refuse   bool // Refuse the first permission.
+		want     string
+	}{
+		{false, false, "user:owner:" + drivefake.Me + ",user:reader:a@example.com,group:writer:g@example.com,domain:reader:example.com"},
+		{true, false, "user:owner:" + drivefake.Me + ",user:writer:old@example.com,user:reader:a@example.com,group:writer:g@example.com,domain:reader:example.com"},
+		{false, true, "user:owner:" + drivefake.Me + ",group:writer:g@example.com,domain:reader:example.com"},
+	} {
+		*shareOld = test.shareOld
+		if test.refuse {
+			s.Inject(drivefake.Fault{Op: "Permissions.Insert", Code: 400, Reason: "invalidSharingRequest", Times: 1})
+		}
+		journ = newJournal()
+		s.File("f").Labels.Trashed = false
+		if err := migrate(d, d, s.Client(), &lib.File{File: s.File("f")}); err != nil {
+			t.Fatal(err)
+		}
+		id, _ := journ.copy("f")
+		var got []string
+		for _, p := range s.Permissions(id) {
+			got = append(got, p.Type+":"+p.Role+":"+p.EmailAddress+p.Domain)
+		}
+		if strings.Join(got, ",") != test.want {
+			t.Errorf("-share-old-owner=%v, refuse=%v: got %q, want %q", test.shareOld, test.refuse, got, test.want)
+		}
+		c := s.File(id)
+		if c.ModifiedDate != date || !c.Labels.Starred {
+			t.Errorf("copy: got modifiedDate %q, starred %v, want %q, true", c.ModifiedDate, c.Labels.Starred, date)
+		}
+	}
+}
+
+func TestMigrateAllUsers(t *testing.T) {
+	src, srcd := setup(t)
+	dst, dstd := setup(t)
+	src.AddFolder("a", "a", "src")
+	other := []*drive.User{{EmailAddress: "other@example.com"}}
+	src.Add(&drive.File{Id: "f1", Title: "f1", Owners: other, Parents: []*drive.ParentReference{{Id: "a"}}}, []byte("1"))
+	src.Add(&drive.File{Id: "f2", Title: "f2", Owners: other, Parents: []*drive.ParentReference{{Id: "src"}}}, []byte("22"))
+	sel, err := newFilter(notMe, dstEmail, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The source is walked and read as the source user, and copies are
+	// written as the destination user.
+	ch := make(chan *lib.File)
+	go lib.ListRecursive(srcd, 2, ch, "src")
+	if failed := migrateAll(srcd, dstd, src.Client(), ch, sel, 2); failed != 0 {
+		t.Fatalf("%d failed", failed)
+	}
+	for _, id := range []string{"f1", "f2"} {
+		if !src.File(id).Labels.Trashed {
+			t.Errorf("%s not trashed in source", id)
+		}
+	}
+	var got []string
+	for _, id := range dst.Children("dst") {
+		f := dst.File(id)
+		if f.MimeType == lib.DriveFolder {
+			for _, c := range dst.Children(id) {
+				got = append(got, f.Title+"/"+dst.File(c).Title+":"+string(dst.Content(c)))
+			}
+		} else {
+			got = append(got, f.Title+":"+string(dst.Content(id)))
+		}
+	}
+	sort.Strings(got)
+	if got, want := strings.Join(got, ","), "a/f1:1,f2:22"; got != want {
+		t.Errorf("dst: got %q, want %q", got, want)
+	}
+}
+
+func TestMove(t *testing.T) {
+	s, d := setup(t)
+	s.AddFolder("a", "a", "src")
+	s.AddFolder("other", "other")
+	s.AddFile("f", "f", "content", "a", "other")
+	*move = true
+
+	if err := migrate(d, d, s.Client(), &lib.File{Path: []string{"a"}, File: s.File("f")}); err != nil {
+		t.Fatal(err)
+	}
+	a := s.Children("dst")
+	if len(a) != 1 {
+		t.Fatalf("dst: got %d children, want 1", len(a))
+	}
+	if got, want := strings.Join(s.Children(a[0]), ","), "f"; got != want {
+		t.Errorf("dst/a: got %q, want %q", got, want)
+	}
+	if got := len(s.Children("a")) + len(s.Children("other")); got != 0 {
+		t.Errorf("still in %d old folders", got)
+	}
+	if s.File("f").Labels.Trashed || !journ.isDone("f") {
+		t.Errorf("f trashed or not done")
+	}
+	if got := s.Calls("Files.Insert"); got != 1 {
+		t.Errorf("got %d Files.Insert calls, want 1 for the folder", got)
+	}
+}
+
+func TestInside(t *testing.T) {
+	s, d := setup(t)
+	s.AddFolder("a", "a", "src")
+	s.AddFolder("b", "b", "a", "dst")
+	for _, test := range []struct {
+		id, dir string
+		want    bool
+	}{
+		{"src", "src", true},
+		{"b", "src", true},
+		{"b", "dst", true},
+		{"dst", "src", false},
+		{"src", "b", false},
+	} {
+		got, err := inside(d, test.id, test.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("inside(%q, %q): got %v, want %v", test.id, test.dir, got, test.want)
+		}
+	}
+}
+
+// breakOnce fails the first download after n bytes.
+type breakOnce struct {
+	rt   http.RoundTripper
+	n    int64
+	done bool
+}
+
+func (t *breakOnce) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := t.rt.RoundTrip(r)
+	if err != nil || r.URL.Query().Get("alt") != "media" || t.done {
+		return resp, err
+	}
+	t.done = true
+	resp.Body = ioutil.NopCloser(io.MultiReader(io.LimitReader(resp.Body, t.n), &errReader{io.ErrUnexpectedEOF}))
+	return resp, nil
+}
+
+type errReader struct{ err error }
+
+func (r *errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestCopyFileResume(t *testing.T) {
+	s, d := setup(t)
+	content := strings.Repeat("0123456789abcdef", 200000)
+	src := s.AddFile("f", "f", content, "src")
+	*chunkSize = 1
+
+	// The download breaks once and is resumed, and an upload chunk fails
+	// once and is sent again.
+	c := &http.Client{Transport: &breakOnce{rt: s.Client().Transport, n: 1000}}
+	s.Inject(drivefake.Fault{Op: "Files.Upload", Code: 503, Reason: "backendError", Times: 1})
+	if err := copyFile(d, c, nil, src, "copy"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(s.Content("copy")); got != content {
+		t.Errorf("content: got %d bytes, want %d", len(got), len(content))
+	}
+	if got, want := s.Calls("Files.Download"), 2; got != want {
+		t.Errorf("got %d downloads, want %d", got, want)
+	}
+	if got, want := s.Calls("Files.Upload"), 5; got != want {
+		t.Errorf("got %d chunks sent, want %d", got, want)
+	}
+}
+
+func TestProgressBars(t *testing.T) {
+	start := time.Now()
+	p := newProgress()
+	p.start = start
+	a := &lib.File{File: &drive.File{Title: "a", FileSize: 1000}}
+	b := &lib.File{File: &drive.File{Title: "b", FileSize: 1000}}
+	p.queue(a)
+	p.queue(b)
+	r, done := p.track(a.File, strings.NewReader(strings.Repeat("x", 1000)))
+	for fp := range p.active {
+		fp.start = start
+	}
+	if _, err := io.ReadFull(r, make([]byte, 500)); err != nil {
+		t.Fatal(err)
+	}
+
+	got := strings.Join(p.bars(start.Add(10*time.Second)), "\n")
+	want := "[==========>         ]  50% 500 B/1000 B, 50 B/s, ETA 10s  a\n" +
+		"[=====>              ]  25% 500 B/2.0 KiB, 50 B/s, ETA 30s  0/2 files"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	done()
+	p.add(a, nil)
+	got = strings.Join(p.bars(start.Add(10*time.Second)), "\n")
+	want = "[==========>         ]  50% 1000 B/2.0 KiB, 100 B/s, ETA 10s  1/2 files"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
 }
@@ -0,0 +1,105 @@
+package main
+
+/*
+ * This file contains downloads that resume where they stopped.
+ */
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"google.golang.org/api/googleapi"
+
+	"github.com/ThomasHabets/drive-du/lib"
+)
+
+// download reads a file, resuming with a Range request where it stopped if
+// reading fails, up to downloadRetries times in a row with backoff.
+type download struct {
+	t     *http.Client
+	url   string
+	off   int64 // Bytes read so far.
+	body  io.ReadCloser
+	fails int // Failures in a row.
+	back  lib.Backoff
+}
+
+// openDownload starts downloading url.
+func openDownload(t *http.Client, url string) (*download, error) {
+	d := &download{t: t, url: url}
+	if err := d.open(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *download) open() error {
+	req, err := http.NewRequest("GET", d.url, nil)
+	if err != nil {
+		return err
+	}
+	want := http.StatusOK
+	if d.off > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.off))
+		want = http.StatusPartialContent
+	}
+	resp, err := d.t.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != want {
+		defer resp.Body.Close()
+		// As an API error, so that e.g. a refused download isn't retried.
+		if err := googleapi.CheckResponse(resp); err != nil {
+			return err
+		}
+		return fmt.Errorf("downloading status: want %d, got %d", want, resp.StatusCode)
+	}
+	d.body = resp.Body
+	return nil
+}
+
+func (d *download) Read(p []byte) (int, error) {
+	for {
+		var err error
+		if d.body == nil {
+			err = d.open()
+		}
+		if err == nil {
+			var n int
+			n, err = d.body.Read(p)
+			d.off += int64(n)
+			if err == nil || err == io.EOF {
+				if n > 0 {
+					d.fails = 0
+					d.back.Reset()
+				}
+				return n, err
+			}
+			d.body.Close()
+			d.body = nil
+			if n > 0 {
+				// Resume on the next read.
+				return n, nil
+			}
+		}
+		if d.fails++; d.fails > downloadRetries {
+			return 0, err
+		}
+		log.Printf("Download failed after %d bytes, resuming: %v", d.off, err)
+		if err := d.back.Wait(context.Background()); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Close closes the connection.
+func (d *download) Close() error {
+	if d.body == nil {
+		return nil
+	}
+	return d.body.Close()
+}
@@ -0,0 +1,78 @@
+package main
+
+/*
+ * This file contains the selection of files to copy.
+ */
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/ThomasHabets/drive-du/lib"
+)
+
+// notMe is the owner that matches files not owned by the destination user.
+const notMe = "notme"
+
+// filter selects files by owner, path and MIME type.
+type filter struct {
+	owners map[string]bool // Lowercase owner emails. Empty matches anyone.
+	me     string          // Lowercase email of the destination user.
+	notMe  bool            // Also match files not owned by me.
+	path   string          // Shell pattern for the path, or "" for any.
+	mime   string          // Shell pattern for the MIME type, or "" for any.
+}
+
+// newFilter creates a filter. owners is a comma separated list of emails,
+// which may include "notme", meaning anyone but me.
+func newFilter(owners, me, pathGlob, mimeGlob string) (*filter, error) {
+	f := &filter{
+		owners: make(map[string]bool),
+		me:     strings.ToLower(me),
+		path:   pathGlob,
+		mime:   mimeGlob,
+	}
+	for _, o := range strings.Split(owners, ",") {
+		switch o = strings.ToLower(strings.TrimSpace(o)); o {
+		case "":
+		case notMe:
+			f.notMe = true
+		default:
+			f.owners[o] = true
+		}
+	}
+	for _, p := range []string{pathGlob, mimeGlob} {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %v", p, err)
+		}
+	}
+	return f, nil
+}
+
+// match returns true if e should be copied.
+func (f *filter) match(e *lib.File) bool {
+	if f.path != "" {
+		p := strings.Join(append(append([]string(nil), e.Path...), e.File.Title), "/")
+		if ok, _ := path.Match(f.path, p); !ok {
+			return false
+		}
+	}
+	if f.mime != "" {
+		if ok, _ := path.Match(f.mime, e.File.MimeType); !ok {
+			return false
+		}
+	}
+	if len(f.owners) == 0 && !f.notMe {
+		return true
+	}
+	mine := false
+	for _, o := range e.File.Owners {
+		email := strings.ToLower(o.EmailAddress)
+		if f.owners[email] {
+			return true
+		}
+		mine = mine || email == f.me
+	}
+	return f.notMe && !mine
+}
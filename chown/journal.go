@@ -0,0 +1,178 @@
+package main
+
+/*
+ * This file contains the journal that makes migrations resumable.
+ *
+ * The journal is a file of JSON entries, one per line, that is appended to
+ * and synced before and after every change. IDs of new folders and files are
+ * generated and recorded before they're created, so a rerun can check if an
+ * interrupted create actually happened instead of creating it again.
+ */
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Journal operations.
+const (
+	opMkdirStart = "mkdir-start" // About to create folder Path with ID Dst.
+	opMkdir      = "mkdir"       // Created folder Path with ID Dst.
+	opCopyStart  = "copy-start"  // About to copy Src to new file Dst.
+	opCopy       = "copy"        // Copied Src to Dst.
+	opTrash      = "trash"       // Trashed Src.
+	opTransfer   = "transfer"    // Transferred ownership of Src.
+	opMove       = "move"        // Moved Src.
+)
+
+// entry is one line in the journal.
+type entry struct {
+	Op   string   `json:"op"`
+	Path []string `json:"path,omitempty"`
+	Src  string   `json:"src,omitempty"`
+	Dst  string   `json:"dst,omitempty"`
+}
+
+// journal records progress. With no file it's only kept in memory.
+type journal struct {
+	mutex sync.Mutex
+	f     *os.File
+
+	dirs    map[string]string // Destination folder IDs by path key.
+	dirDone map[string]bool   // Path keys of folders known to exist.
+	copies  map[string]string // Destination file IDs by source ID.
+	copied  map[string]bool   // Source IDs known to be copied.
+	done    map[string]bool   // Source IDs trashed or transferred.
+}
+
+func newJournal() *journal {
+	return &journal{
+		dirs:    make(map[string]string),
+		dirDone: make(map[string]bool),
+		copies:  make(map[string]string),
+		copied:  make(map[string]bool),
+		done:    make(map[string]bool),
+	}
+}
+
+// openJournal opens a journal file, replaying what's already in it. An empty
+// file name gives a journal that's only kept in memory.
+func openJournal(fn string) (*journal, error) {
+	j := newJournal()
+	if fn == "" {
+		return j, nil
+	}
+	f, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	var good int64
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// A partial last line is from a crash while writing it, so
+			// it never happened.
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		var e entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s:%d: %v", fn, n, err)
+		}
+		j.apply(&e)
+		good += int64(len(line))
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	j.f = f
+	return j, nil
+}
+
+// Close closes the journal file.
+func (j *journal) Close() error {
+	if j.f == nil {
+		return nil
+	}
+	return j.f.Close()
+}
+
+func pathKey(p []string) string {
+	return strings.Join(p, folderSeparator)
+}
+
+func (j *journal) apply(e *entry) {
+	switch e.Op {
+	case opMkdirStart:
+		j.dirs[pathKey(e.Path)] = e.Dst
+	case opMkdir:
+		j.dirs[pathKey(e.Path)] = e.Dst
+		j.dirDone[pathKey(e.Path)] = true
+	case opCopyStart:
+		j.copies[e.Src] = e.Dst
+	case opCopy:
+		j.copies[e.Src] = e.Dst
+		j.copied[e.Src] = true
+	case opTrash, opTransfer, opMove:
+		j.done[e.Src] = true
+	}
+}
+
+// record writes an entry to the journal and syncs it to disk.
+func (j *journal) record(e *entry) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.f != nil {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := j.f.Write(append(b, '\n')); err != nil {
+			return err
+		}
+		if err := j.f.Sync(); err != nil {
+			return err
+		}
+	}
+	j.apply(e)
+	return nil
+}
+
+// dir returns the ID of the destination folder for path p, and true if the
+// folder is known to exist. If the ID is empty it hasn't been created yet.
+func (j *journal) dir(p []string) (string, bool) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.dirs[pathKey(p)], j.dirDone[pathKey(p)]
+}
+
+// copy returns the ID of the copy of src, and true if the copy is known to
+// be complete. If the ID is empty copying hasn't started.
+func (j *journal) copy(src string) (string, bool) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.copies[src], j.copied[src]
+}
+
+// isDone returns true if src has been copied and trashed, transferred or
+// moved.
+func (j *journal) isDone(src string) bool {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.done[src]
+}
@@ -0,0 +1,90 @@
+package main
+
+/*
+ * This file contains the worker pool that migrates files concurrently.
+ */
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/ThomasHabets/drive-du/lib"
+)
+
+// migrateAll migrates the files from ch that sel matches, using workers
+// concurrent workers, and returns the number that failed. Files already done
+// according to the journal, or seen before in another folder, are skipped.
+func migrateAll(srcd, dstd *drive.Service, srct *http.Client, ch <-chan *lib.File, sel *filter, workers int) int {
+	if workers < 1 {
+		workers = 1
+	}
+	prog = newProgress()
+	todo := make(chan *lib.File)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range todo {
+				err := migrate(srcd, dstd, srct, e)
+				if err != nil {
+					// The source is left alone, so it can be retried later.
+					log.Print(err)
+				}
+				prog.add(e, err)
+			}
+		}()
+	}
+
+	stop := make(chan struct{})
+	var logs, redraws <-chan time.Time
+	if *progEvery > 0 {
+		t := time.NewTicker(*progEvery)
+		defer t.Stop()
+		logs = t.C
+	}
+	var term *terminal
+	if *showBars {
+		term = &terminal{w: os.Stderr, p: prog}
+		log.SetOutput(term)
+		defer log.SetOutput(os.Stderr)
+		t := time.NewTicker(barEvery)
+		defer t.Stop()
+		redraws = t.C
+	}
+	go func() {
+		for {
+			select {
+			case <-logs:
+				log.Printf("Progress: %v", prog)
+			case <-redraws:
+				term.redraw()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	seen := make(map[string]bool)
+	for e := range ch {
+		if seen[e.File.Id] {
+			continue
+		}
+		seen[e.File.Id] = true
+		if !sel.match(e) || journ.isDone(e.File.Id) {
+			continue
+		}
+		prog.queue(e)
+		todo <- e
+	}
+	close(todo)
+	wg.Wait()
+	close(stop)
+	log.Printf("Done: %v", prog)
+	return prog.failed
+}
@@ -0,0 +1,237 @@
+package main
+
+/*
+ * This file contains progress reporting, as log lines and as progress bars
+ * with speed and ETA for each file being copied and overall.
+ */
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/ThomasHabets/drive-du/lib"
+)
+
+const barWidth = 20
+
+// progress counts migrated files. It's safe for concurrent use.
+type progress struct {
+	mutex       sync.Mutex
+	start       time.Time
+	queued      int   // Files matched and not already done.
+	transferred int   // Files whose ownership was transferred.
+	moved       int   // Files moved with -move.
+	copied      int   // Files copied and trashed.
+	failed      int   // Files that failed.
+	bytes       int64 // Bytes of files copied.
+	size        int64 // Bytes of files queued.
+	finished    int64 // Bytes of files done or failed.
+
+	active map[*fileProgress]bool // Files being copied.
+}
+
+// fileProgress is a file being copied.
+type fileProgress struct {
+	title string
+	size  int64
+	done  int64
+	start time.Time
+}
+
+func newProgress() *progress {
+	return &progress{
+		start:  time.Now(),
+		active: make(map[*fileProgress]bool),
+	}
+}
+
+// prog is the progress of the current run.
+var prog = newProgress()
+
+// queue records that e will be migrated.
+func (p *progress) queue(e *lib.File) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.queued++
+	p.size += e.File.FileSize
+}
+
+// add records the outcome of migrating e.
+func (p *progress) add(e *lib.File, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.finished += e.File.FileSize
+	switch _, copied := journ.copy(e.File.Id); {
+	case err != nil:
+		p.failed++
+	case *move:
+		p.moved++
+	case copied:
+		p.copied++
+		p.bytes += e.File.FileSize
+	default:
+		p.transferred++
+	}
+}
+
+// track returns a reader counting what's read from r as progress copying f,
+// and a func to call when done with it.
+func (p *progress) track(f *drive.File, r io.Reader) (io.Reader, func()) {
+	fp := &fileProgress{title: f.Title, size: f.FileSize, start: time.Now()}
+	p.mutex.Lock()
+	p.active[fp] = true
+	p.mutex.Unlock()
+	return &counter{p: p, fp: fp, r: r}, func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		delete(p.active, fp)
+	}
+}
+
+// counter counts bytes read as progress.
+type counter struct {
+	p  *progress
+	fp *fileProgress
+	r  io.Reader
+}
+
+func (c *counter) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.p.mutex.Lock()
+	c.fp.done += int64(n)
+	c.p.mutex.Unlock()
+	return n, err
+}
+
+// overall returns bytes done, including files being copied, and the total.
+// Must be called with the mutex held.
+func (p *progress) overall() (int64, int64) {
+	done := p.finished
+	for fp := range p.active {
+		done += fp.done
+	}
+	return done, p.size
+}
+
+// rate returns bytes per second, and a formatted ETA.
+func rate(done, total int64, d time.Duration) (float64, string) {
+	if d < time.Second {
+		return 0, "?"
+	}
+	r := float64(done) / d.Seconds()
+	if r == 0 {
+		return 0, "?"
+	}
+	if done >= total {
+		return r, "0s"
+	}
+	return r, time.Duration(float64(total-done) / r * float64(time.Second)).Round(time.Second).String()
+}
+
+func (p *progress) String() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	files := p.transferred + p.moved + p.copied + p.failed
+	if *move {
+		return fmt.Sprintf("%d/%d files done, %d moved, %d failed", files, p.queued, p.moved, p.failed)
+	}
+	s := fmt.Sprintf("%d/%d files done, %d transferred, %d copied (%s), %d failed",
+		files, p.queued, p.transferred, p.copied, lib.Size(p.bytes).Binary(), p.failed)
+	done, total := p.overall()
+	if r, eta := rate(done, total, time.Since(p.start)); r > 0 {
+		s += fmt.Sprintf(", %s/s, ETA %s", lib.Size(r).Binary(), eta)
+	}
+	return s
+}
+
+// bar formats a progress bar with speed and ETA.
+func bar(done, total int64, d time.Duration) string {
+	frac := 1.0
+	if total > 0 {
+		frac = float64(done) / float64(total)
+	}
+	if frac > 1 {
+		frac = 1
+	}
+	n := int(frac * barWidth)
+	b := strings.Repeat("=", n)
+	if n < barWidth {
+		b += ">" + strings.Repeat(" ", barWidth-n-1)
+	}
+	r, eta := rate(done, total, d)
+	return fmt.Sprintf("[%s] %3.0f%% %s/%s, %s/s, ETA %s",
+		b, 100*frac, lib.Size(done).Binary(), lib.Size(total).Binary(), lib.Size(r).Binary(), eta)
+}
+
+// bars returns a progress bar for every file being copied, oldest first,
+// and one for all files.
+func (p *progress) bars(now time.Time) []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var active []*fileProgress
+	for fp := range p.active {
+		active = append(active, fp)
+	}
+	sort.Slice(active, func(i, j int) bool {
+		if !active[i].start.Equal(active[j].start) {
+			return active[i].start.Before(active[j].start)
+		}
+		return active[i].title < active[j].title
+	})
+	var ret []string
+	for _, fp := range active {
+		ret = append(ret, fmt.Sprintf("%s  %s", bar(fp.done, fp.size, now.Sub(fp.start)), fp.title))
+	}
+	done, total := p.overall()
+	files := p.transferred + p.moved + p.copied + p.failed
+	ret = append(ret, fmt.Sprintf("%s  %d/%d files", bar(done, total, now.Sub(p.start)), files, p.queued))
+	return ret
+}
+
+// terminal draws progress bars below what's logged to it.
+type terminal struct {
+	mutex sync.Mutex
+	w     io.Writer
+	p     *progress
+	lines int // Lines of bars drawn.
+}
+
+// Write writes log output above the bars.
+func (t *terminal) Write(b []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.clear()
+	n, err := t.w.Write(b)
+	t.draw()
+	return n, err
+}
+
+// redraw draws the bars again, with current progress.
+func (t *terminal) redraw() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.clear()
+	t.draw()
+}
+
+// clear erases the bars. Must be called with the mutex held.
+func (t *terminal) clear() {
+	// Cursor up one line, and erase it.
+	fmt.Fprint(t.w, strings.Repeat("\033[1A\033[2K", t.lines))
+	t.lines = 0
+}
+
+// draw draws the bars. Must be called with the mutex held.
+func (t *terminal) draw() {
+	lines := t.p.bars(time.Now())
+	for _, l := range lines {
+		fmt.Fprintln(t.w, l)
+	}
+	t.lines = len(lines)
+}
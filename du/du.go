@@ -1,4 +1,5 @@
-// du is meant to be something like the unix binary du. Currently does appox "du -hcs $FOLDER/*".
+// du is meant to be something like the unix binary du. By default does appox "du -hcs $FOLDER/*",
+// and with -tree, -d or -a lists every folder like "du -d N".
 //
 // Configure with:  ./du -config du.json -configure
 // Then run with:   ./du -config du.json 0x_XXXXNNNNAAAABBB
@@ -6,10 +7,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"sort"
+	"strings"
 
 	drive "google.golang.org/api/drive/v2"
 
@@ -20,14 +25,46 @@ var (
 	config     = flag.String("config", "", "Config file.")
 	configure  = flag.Bool("configure", false, "Configure oauth.")
 	workers    = flag.Int("workers", 10, "Number of Google API workers.")
+	qps        = flag.Float64("qps", 0, "Most Google API requests per second, for all workers together. 0 is unlimited.")
+	bwlimit    = flag.String("bwlimit", "", "Most bytes per second downloaded and uploaded, e.g. \"10M\". Empty is unlimited.")
 	sortBySize = flag.Bool("s", false, "Sort by size.")
+	cacheFile  = flag.String("cache", "", "Cache file, to speed up repeated runs.")
+	snapshot   = flag.String("snapshot", "", "Snapshot file. If set, only changes since the last run are fetched.")
+	tree       = flag.Bool("tree", false, "Output every folder as \"size<TAB>path\", like du(1).")
+	all        = flag.Bool("a", false, "Output files too, not just folders. Implies -tree.")
+	inodes     = flag.Bool("inodes", false, "Output file counts instead of sizes in -tree mode.")
+	format     = flag.String("format", "text", "Output format: text, json, ndjson or csv.")
+	human      = flag.Bool("h", false, "Output sizes in powers of 1024 (KiB, MiB, GiB, ...).")
+	si         = flag.Bool("si", false, "Output sizes in powers of 1000 (kB, MB, GB, ...).")
+	precision  = flag.Int("precision", 1, "Digits after the decimal point with -h and -si.")
+	nativeSize = flag.Bool("native-quota", false, "Use quotaBytesUsed as the size of Google-native documents, where available.")
+	quota      = flag.Bool("quota", false, "Use quotaBytesUsed as the size of all files. This is what counts against the storage limit.")
+	revisions  = flag.Bool("revisions", false, "List the revisions of every file and report space used by old revisions. Slow.")
+	maxDepth   int
 )
 
+func init() {
+	const usage = "Only output folders this many levels deep. Implies -tree."
+	flag.IntVar(&maxDepth, "d", -1, usage)
+	flag.IntVar(&maxDepth, "max-depth", -1, usage)
+}
+
 const (
 	scope      = "https://www.googleapis.com/auth/drive.readonly.metadata"
 	accessType = "offline"
 )
 
+// units returns the size units selected by flags.
+func units() lib.Units {
+	switch {
+	case *si:
+		return lib.UnitsSI
+	case *human:
+		return lib.UnitsBinary
+	}
+	return lib.UnitsBytes
+}
+
 func main() {
 	flag.Parse()
 	if *config == "" {
@@ -45,40 +82,131 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	limits, err := lib.ParseLimits(*qps, *bwlimit)
+	if err != nil {
+		log.Fatalf("-bwlimit: %v", err)
+	}
 	t, err := lib.Connect(conf.OAuth, scope, accessType)
 	if err != nil {
 		log.Fatal(err)
 	}
-	d, err := drive.New(t)
+	d, err := drive.New(limits.Client(t))
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	opts := &lib.ListOptions{
+		Workers:        *workers,
+		IncludeFolders: true,
+	}
+	if *cacheFile != "" {
+		if opts.Cache, err = lib.OpenCache(*cacheFile); err != nil {
+			log.Fatal(err)
+		}
+	}
 	ch := make(chan *lib.File)
-	go lib.ListRecursive(d, *workers, ch, flag.Args()[0])
+	errCh := make(chan error, 1)
+	go func() {
+		if *snapshot != "" {
+			errCh <- lib.ListSnapshot(context.Background(), d, ch, flag.Args()[0], *snapshot, opts)
+		} else {
+			errCh <- lib.ListRecursiveContext(context.Background(), d, ch, flag.Args()[0], opts)
+		}
+	}()
 	//log.Println("Running...")
 	//log.Println("Streaming results...")
 	var size int64
 	dirSizes := make(map[string]int64)
+	dirNative := make(map[string]int64)
 	storageByOwner := make(map[string]int64)
+	filesByOwner := make(map[string]int64)
+	nativeByType := make(map[string]int64)
 	seen := make(map[string]bool)
+	dirTree := lib.NewTree(".")
+	var revFiles []*lib.File
 	for e := range ch {
+		if e.File.MimeType == lib.DriveFolder {
+			dirTree.AddFolder(e.Path, e.PathIDs, e.File.Title, e.File.Id)
+			continue
+		}
 		if seen[e.File.Id] {
 			continue
 		}
 		seen[e.File.Id] = true
-		size += e.File.FileSize
-		for _, o := range e.File.Owners {
-			storageByOwner[o.EmailAddress] += e.File.FileSize
+
+		// Google-native documents have no size, so they are counted
+		// separately unless their quota usage is wanted and known.
+		fileSize := e.File.FileSize
+		native := lib.IsNative(e.File)
+		switch {
+		case *quota:
+			fileSize, native = e.File.QuotaBytesUsed, false
+		case native && *nativeSize && e.File.QuotaBytesUsed > 0:
+			fileSize, native = e.File.QuotaBytesUsed, false
+		}
+		dir := e.File.Title
+		if len(e.Path) > 0 {
+			dir = e.Path[0] + "/"
 		}
-		if len(e.Path) == 0 {
-			dirSizes[e.File.Title] += e.File.FileSize
+		if native {
+			dirTree.AddNative(e.Path, e.PathIDs, e.File.Title, e.File.Id)
+			nativeByType[e.File.MimeType]++
+			dirNative[dir]++
 		} else {
-			dirSizes[e.Path[0]+"/"] += e.File.FileSize
+			dirTree.Add(e.Path, e.PathIDs, e.File.Title, e.File.Id, fileSize)
+		}
+		if *revisions && !lib.IsNative(e.File) {
+			revFiles = append(revFiles, e)
+		}
+		size += fileSize
+		for _, o := range e.File.Owners {
+			storageByOwner[o.EmailAddress] += fileSize
+			filesByOwner[o.EmailAddress]++
+		}
+		dirSizes[dir] += fileSize
+	}
+	if err := <-errCh; err != nil {
+		log.Fatal(err)
+	}
+	if opts.Cache != nil {
+		if err := opts.Cache.Save(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	dirRevs := make(map[string]int64)
+	if *revisions {
+		revs, err := lib.RevisionSizes(context.Background(), d, revFiles, *workers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for e, n := range revs {
+			dirTree.AddRevisions(e.Path, e.PathIDs, e.File.Title, e.File.Id, n)
+			if len(e.Path) == 0 {
+				dirRevs[e.File.Title] += n
+			} else {
+				dirRevs[e.Path[0]+"/"] += n
+			}
 		}
 	}
 
-	fmt.Printf("Storage by folder\n----------------\n  T   G   M   k   B\n")
+	treeMode := *tree || *all || maxDepth >= 0
+	if *format != "text" {
+		r := newReport(dirTree, treeMode, maxDepth, *all, storageByOwner, filesByOwner, nativeByType)
+		if err := writeReport(os.Stdout, *format, r); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if treeMode {
+		writeTree(os.Stdout, dirTree, maxDepth, *all)
+		return
+	}
+
+	header := "  T   G   M   k   B\n"
+	if units() != lib.UnitsBytes {
+		header = ""
+	}
+	fmt.Printf("Storage by folder\n----------------\n%s", header)
 	// Output directories.
 	var ds []lib.SizeEntry
 	for k, v := range dirSizes {
@@ -93,12 +221,19 @@ func main() {
 		sort.Sort(lib.ByName(ds))
 	}
 	for _, d := range ds {
-		fmt.Printf("%19s %s\n", d.Value.Pretty(), d.Key)
+		note := ""
+		if n := dirNative[d.Key]; n > 0 {
+			note = fmt.Sprintf(" (%d native docs not counted in size)", n)
+		}
+		if n := dirRevs[d.Key]; n > 0 {
+			note += fmt.Sprintf(" (%s in old revisions)", lib.Size(n).Format(units(), *precision))
+		}
+		fmt.Printf("%19s %s%s\n", d.Value.Format(units(), *precision), d.Key, note)
 	}
 	fmt.Printf("\n")
 
 	// Output owners.
-	fmt.Printf("Storage by owner\n----------------\n  T   G   M   k   B\n")
+	fmt.Printf("Storage by owner\n----------------\n%s", header)
 	ds = nil
 	for k, v := range storageByOwner {
 		ds = append(ds, lib.SizeEntry{
@@ -108,9 +243,49 @@ func main() {
 	}
 	sort.Sort(lib.BySize(ds))
 	for _, d := range ds {
-		fmt.Printf("%19s %s\n", d.Value.Pretty(), d.Key)
+		fmt.Printf("%19s %s\n", d.Value.Format(units(), *precision), d.Key)
 	}
 	fmt.Printf("\n")
 
-	fmt.Println("Total size: ", lib.Pretty(size))
+	// Output native document counts.
+	if len(nativeByType) > 0 {
+		fmt.Printf("Google-native documents not counted in size\n-------------------------------------------\n")
+		var types []string
+		for k := range nativeByType {
+			types = append(types, k)
+		}
+		sort.Strings(types)
+		for _, k := range types {
+			fmt.Printf("%19d %s\n", nativeByType[k], k)
+		}
+		fmt.Printf("\n")
+	}
+
+	fmt.Println("Total size: ", lib.Size(size).Format(units(), *precision))
+	if *revisions {
+		fmt.Println("Old revisions:", lib.Size(dirTree.Revs).Format(units(), *precision))
+	}
+}
+
+// writeTree writes the size of every folder in t, and files too if files is
+// true, like the unix du. Folders with native documents, which aren't counted
+// in the size, get a note after the path saying how many.
+func writeTree(w io.Writer, t *lib.Tree, maxDepth int, files bool) {
+	t.Walk(maxDepth, files, func(path []string, n *lib.Tree) {
+		v := fmt.Sprint(n.Size)
+		switch {
+		case *inodes:
+			v = fmt.Sprint(n.Files)
+		case units() != lib.UnitsBytes:
+			v = lib.Size(n.Size).Format(units(), *precision)
+		}
+		if *revisions {
+			v += "\t" + lib.Size(n.Revs).Format(units(), *precision)
+		}
+		note := ""
+		if n.Native > 0 {
+			note = fmt.Sprintf("\t(%d native docs not counted in size)", n.Native)
+		}
+		fmt.Fprintf(w, "%s\t%s%s\n", v, strings.Join(append([]string{"."}, path...), "/"), note)
+	})
 }
@@ -1,8 +1,120 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"strings"
 	"testing"
+
+	"github.com/ThomasHabets/drive-du/lib"
 )
 
 func TestBuilds(t *testing.T) {
 }
+
+func testReport() *report {
+	t := lib.NewTree(".")
+	t.AddFolder(nil, nil, "a", "id-a")
+	t.Add([]string{"a"}, []string{"id-a"}, "f1", "id-1", 100)
+	t.Add(nil, nil, "f2", "id-2", 20)
+	t.AddNative([]string{"a"}, []string{"id-a"}, "doc", "id-3")
+	t.AddRevisions([]string{"a"}, []string{"id-a"}, "f1", "id-1", 50)
+	return newReport(t, false, -1, false,
+		map[string]int64{"x@example.com": 100, "y@example.com": 20},
+		map[string]int64{"x@example.com": 2, "y@example.com": 1},
+		map[string]int64{"application/vnd.google-apps.document": 1})
+}
+
+func TestReportCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeReport(&buf, "csv", testReport()); err != nil {
+		t.Fatal(err)
+	}
+	want := `section,key,id,bytes,files,native,revisions
+folder,a/,id-a,100,2,1,50
+folder,f2,id-2,20,1,0,0
+owner,x@example.com,,100,2,0,0
+owner,y@example.com,,20,1,0,0
+native,application/vnd.google-apps.document,,0,1,1,0
+total,,,120,3,1,50
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestReportNDJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeReport(&buf, "ndjson", testReport()); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if got, want := len(lines), 6; got != want {
+		t.Fatalf("got %d lines, want %d", got, want)
+	}
+	if got, want := lines[0], `{"section":"folder","key":"a/","id":"id-a","bytes":100,"files":2,"native":1,"revisions":50}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestReportJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeReport(&buf, "json", testReport()); err != nil {
+		t.Fatal(err)
+	}
+	var r report
+	if err := json.Unmarshal(buf.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.Total.Bytes, int64(120); got != want {
+		t.Errorf("total: got %d, want %d", got, want)
+	}
+	if got, want := len(r.Folders), 2; got != want {
+		t.Errorf("folders: got %d, want %d", got, want)
+	}
+}
+
+func TestReportTree(t *testing.T) {
+	tr := lib.NewTree(".")
+	tr.Add([]string{"a", "b"}, []string{"id-a", "id-b"}, "f1", "id-1", 100)
+	r := newReport(tr, true, 1, false, nil, nil, nil)
+	var keys []string
+	for _, f := range r.Folders {
+		keys = append(keys, f.Key)
+	}
+	if got, want := strings.Join(keys, ","), "./a,."; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReportUnknownFormat(t *testing.T) {
+	if err := writeReport(&bytes.Buffer{}, "xml", testReport()); err == nil {
+		t.Errorf("want error for unknown format")
+	}
+}
+
+func TestWriteTree(t *testing.T) {
+	tr := lib.NewTree(".")
+	tr.AddFolder(nil, nil, "a", "id-a")
+	tr.AddFolder(nil, nil, "b", "id-b")
+	tr.Add([]string{"a"}, []string{"id-a"}, "f1", "id-1", 100)
+	tr.Add([]string{"b"}, []string{"id-b"}, "f2", "id-2", 20)
+	tr.AddNative([]string{"a"}, []string{"id-a"}, "doc", "id-3")
+	var buf bytes.Buffer
+	writeTree(&buf, tr, -1, false)
+	want := "100\t./a\t(1 native docs not counted in size)\n" +
+		"20\t./b\n" +
+		"120\t.\t(1 native docs not counted in size)\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Without native documents, there are no notes.
+	tr = lib.NewTree(".")
+	tr.Add(nil, nil, "f1", "id-1", 100)
+	buf.Reset()
+	writeTree(&buf, tr, -1, true)
+	if got, want := buf.String(), "100\t./f1\n100\t.\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
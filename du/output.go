@@ -0,0 +1,152 @@
+package main
+
+/*
+ * This file contains machine readable output formats.
+ */
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ThomasHabets/drive-du/lib"
+)
+
+const (
+	sectionFolder = "folder"
+	sectionOwner  = "owner"
+	sectionTotal  = "total"
+	sectionNative = "native" // Google-native documents by MIME type.
+)
+
+// record is one line of output.
+type record struct {
+	Section string `json:"section"`
+	Key     string `json:"key"`          // Folder path or owner email.
+	ID      string `json:"id,omitempty"` // Folder or file ID.
+	Bytes   int64  `json:"bytes"`
+	Files   int64  `json:"files"`
+	Native  int64  `json:"native"`    // Google-native documents not counted in Bytes.
+	Revs    int64  `json:"revisions"` // Bytes used by old revisions, with -revisions.
+}
+
+// report is everything du outputs.
+type report struct {
+	Folders []record `json:"folders"`
+	Owners  []record `json:"owners"`
+	Native  []record `json:"native"`
+	Total   record   `json:"total"`
+}
+
+// newReport creates a report. In tree mode the folder section has every
+// folder down to depth, like the text output. Otherwise it has the top level.
+func newReport(t *lib.Tree, treeMode bool, depth int, files bool, ownerBytes, ownerFiles, nativeByType map[string]int64) *report {
+	r := &report{
+		Total: record{
+			Section: sectionTotal,
+			Bytes:   t.Size,
+			Files:   t.Files,
+			Native:  t.Native,
+			Revs:    t.Revs,
+		},
+	}
+	if !treeMode {
+		depth, files = 1, true
+	}
+	t.Walk(depth, files, func(path []string, n *lib.Tree) {
+		key := strings.Join(append([]string{"."}, path...), "/")
+		if !treeMode {
+			if len(path) == 0 {
+				return
+			}
+			key = n.Name
+			if n.Folder {
+				key += "/"
+			}
+		}
+		r.Folders = append(r.Folders, record{
+			Section: sectionFolder,
+			Key:     key,
+			ID:      n.ID,
+			Bytes:   n.Size,
+			Files:   n.Files,
+			Native:  n.Native,
+			Revs:    n.Revs,
+		})
+	})
+	for k, v := range ownerBytes {
+		r.Owners = append(r.Owners, record{
+			Section: sectionOwner,
+			Key:     k,
+			Bytes:   v,
+			Files:   ownerFiles[k],
+		})
+	}
+	sort.Slice(r.Owners, func(i, j int) bool {
+		if r.Owners[i].Bytes != r.Owners[j].Bytes {
+			return r.Owners[i].Bytes > r.Owners[j].Bytes
+		}
+		return r.Owners[i].Key < r.Owners[j].Key
+	})
+	for k, v := range nativeByType {
+		r.Native = append(r.Native, record{
+			Section: sectionNative,
+			Key:     k,
+			Files:   v,
+			Native:  v,
+		})
+	}
+	sort.Slice(r.Native, func(i, j int) bool { return r.Native[i].Key < r.Native[j].Key })
+	return r
+}
+
+func (r *report) records() []record {
+	var ret []record
+	ret = append(ret, r.Folders...)
+	ret = append(ret, r.Owners...)
+	ret = append(ret, r.Native...)
+	return append(ret, r.Total)
+}
+
+// writeReport writes r to w in the given format: json, ndjson or csv.
+func writeReport(w io.Writer, format string, r *report) error {
+	switch format {
+	case "json":
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		return e.Encode(r)
+	case "ndjson":
+		e := json.NewEncoder(w)
+		for _, rec := range r.records() {
+			if err := e.Encode(&rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "csv":
+		c := csv.NewWriter(w)
+		if err := c.Write([]string{"section", "key", "id", "bytes", "files", "native", "revisions"}); err != nil {
+			return err
+		}
+		for _, rec := range r.records() {
+			if err := c.Write([]string{
+				rec.Section,
+				rec.Key,
+				rec.ID,
+				strconv.FormatInt(rec.Bytes, 10),
+				strconv.FormatInt(rec.Files, 10),
+				strconv.FormatInt(rec.Native, 10),
+				strconv.FormatInt(rec.Revs, 10),
+			}); err != nil {
+				return err
+			}
+		}
+		c.Flush()
+		return c.Error()
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
@@ -0,0 +1,248 @@
+// dupes finds duplicate files by md5Checksum and size, and optionally
+// trashes all but one copy of each.
+//
+// Configure with:  ./dupes -config dupes.json -configure
+// Then run with:   ./dupes -config dupes.json 0x_XXXXNNNNAAAABBB
+// (Google Drive folder ID can be found in the Web UI URL)
+//
+// -keep oldest or -keep newest trashes the other copies, and needs -write,
+// also when configuring.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/ThomasHabets/drive-du/lib"
+)
+
+var (
+	config    = flag.String("config", "", "Config file.")
+	configure = flag.Bool("configure", false, "Configure oauth.")
+	workers   = flag.Int("workers", 10, "Number of Google API workers.")
+	qps       = flag.Float64("qps", 0, "Most Google API requests per second, for all workers together. 0 is unlimited.")
+	bwlimit   = flag.String("bwlimit", "", "Most bytes per second downloaded and uploaded, e.g. \"10M\". Empty is unlimited.")
+	cacheFile = flag.String("cache", "", "Cache file, to speed up repeated runs.")
+	snapshot  = flag.String("snapshot", "", "Snapshot file. If set, only changes since the last run are fetched.")
+	human     = flag.Bool("h", false, "Output sizes in powers of 1024 (KiB, MiB, GiB, ...).")
+	keep      = flag.String("keep", "", "Trash all copies but the \"oldest\" or \"newest\" of each set.")
+	write     = flag.Bool("write", false, "Use read-write access, for -keep.")
+	dryRun    bool
+)
+
+func init() {
+	const usage = "Only print what would be trashed."
+	flag.BoolVar(&dryRun, "n", false, usage)
+	flag.BoolVar(&dryRun, "dry-run", false, usage)
+}
+
+const (
+	scope      = "https://www.googleapis.com/auth/drive.readonly.metadata"
+	writeScope = "https://www.googleapis.com/auth/drive"
+	accessType = "offline"
+)
+
+// key identifies a file's content.
+type key struct {
+	md5  string
+	size int64
+}
+
+// set is a set of files with the same content.
+type set struct {
+	key
+	files []*lib.File // Oldest first.
+}
+
+// wasted returns the bytes used by all but one copy.
+func (s *set) wasted() int64 {
+	return s.size * int64(len(s.files)-1)
+}
+
+// group returns all sets of more than one file with the same content,
+// most wasted bytes first. Files without an md5Checksum, like Google-native
+// documents, and empty files are never duplicates. Files in more than one
+// folder are only counted once.
+func group(files []*lib.File) []*set {
+	byKey := make(map[key]*set)
+	seen := make(map[string]bool)
+	for _, f := range files {
+		if f.File.Md5Checksum == "" || f.File.FileSize == 0 || seen[f.File.Id] {
+			continue
+		}
+		seen[f.File.Id] = true
+		k := key{f.File.Md5Checksum, f.File.FileSize}
+		s, ok := byKey[k]
+		if !ok {
+			s = &set{key: k}
+			byKey[k] = s
+		}
+		s.files = append(s.files, f)
+	}
+	var ret []*set
+	for _, s := range byKey {
+		if len(s.files) < 2 {
+			continue
+		}
+		// RFC 3339 dates in UTC sort as strings.
+		sort.Slice(s.files, func(i, j int) bool {
+			a, b := s.files[i].File, s.files[j].File
+			if a.CreatedDate != b.CreatedDate {
+				return a.CreatedDate < b.CreatedDate
+			}
+			return a.Id < b.Id
+		})
+		ret = append(ret, s)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].wasted() != ret[j].wasted() {
+			return ret[i].wasted() > ret[j].wasted()
+		}
+		return ret[i].md5 < ret[j].md5
+	})
+	return ret
+}
+
+// extra returns the copies to trash to keep only the oldest or newest.
+func (s *set) extra(keep string) []*lib.File {
+	if keep == "newest" {
+		return s.files[:len(s.files)-1]
+	}
+	return s.files[1:]
+}
+
+func path(f *lib.File) string {
+	return strings.Join(append(append([]string(nil), f.Path...), f.File.Title), "/")
+}
+
+func size(n int64) string {
+	if *human {
+		return lib.Size(n).Format(lib.UnitsBinary, 1)
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+func trash(ctx context.Context, d *drive.Service, f *lib.File) error {
+	return lib.Retry(ctx, fmt.Sprintf("Files.Trash(%s)", f.File.Id), func() error {
+		_, err := d.Files.Trash(f.File.Id).Fields("id").Context(ctx).Do()
+		return err
+	})
+}
+
+func main() {
+	flag.Parse()
+	if *config == "" {
+		log.Fatalf("-config required")
+	}
+	switch *keep {
+	case "", "oldest", "newest":
+	default:
+		log.Fatalf("-keep must be oldest or newest, not %q", *keep)
+	}
+
+	sc := scope
+	if *write {
+		sc = writeScope
+	}
+	if *configure {
+		if err := lib.ConfigureWrite(sc, accessType, *config); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if flag.NArg() != 1 {
+		log.Fatalf("Usage: %s [flags] <folder ID>", os.Args[0])
+	}
+	if *keep != "" && !*write && !dryRun {
+		log.Fatalf("-keep needs -write, and a config made with -configure -write")
+	}
+
+	conf, err := lib.ReadConfig(*config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	limits, err := lib.ParseLimits(*qps, *bwlimit)
+	if err != nil {
+		log.Fatalf("-bwlimit: %v", err)
+	}
+	t, err := lib.Connect(conf.OAuth, sc, accessType)
+	if err != nil {
+		log.Fatal(err)
+	}
+	d, err := drive.New(limits.Client(t))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+	opts := &lib.ListOptions{Workers: *workers}
+	if *cacheFile != "" {
+		if opts.Cache, err = lib.OpenCache(*cacheFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	ch := make(chan *lib.File)
+	errCh := make(chan error, 1)
+	go func() {
+		if *snapshot != "" {
+			errCh <- lib.ListSnapshot(ctx, d, ch, flag.Arg(0), *snapshot, opts)
+		} else {
+			errCh <- lib.ListRecursiveContext(ctx, d, ch, flag.Arg(0), opts)
+		}
+	}()
+	var files []*lib.File
+	for e := range ch {
+		files = append(files, e)
+	}
+	if err := <-errCh; err != nil {
+		log.Fatal(err)
+	}
+	if opts.Cache != nil {
+		if err := opts.Cache.Save(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var wasted int64
+	var trashed, failed int
+	sets := group(files)
+	for _, s := range sets {
+		wasted += s.wasted()
+		fmt.Printf("%s wasted by %d copies of %s, md5 %s\n", size(s.wasted()), len(s.files), size(s.size), s.md5)
+		extra := make(map[*lib.File]bool)
+		if *keep != "" {
+			for _, f := range s.extra(*keep) {
+				extra[f] = true
+			}
+		}
+		for _, f := range s.files {
+			action := ""
+			if extra[f] {
+				action = " [trash]"
+				if !dryRun {
+					if err := trash(ctx, d, f); err != nil {
+						log.Printf("Failed to trash %q (%s): %v", path(f), f.File.Id, err)
+						action = " [trash failed]"
+						failed++
+					} else {
+						action = " [trashed]"
+						trashed++
+					}
+				}
+			}
+			fmt.Printf("  %s  %s  %s%s\n", f.File.CreatedDate, f.File.Id, path(f), action)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("%d duplicate sets, %s wasted\n", len(sets), size(wasted))
+	if *keep != "" && !dryRun {
+		fmt.Printf("%d files trashed, %d failed\n", trashed, failed)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/ThomasHabets/drive-du/lib"
+)
+
+func TestBuilds(t *testing.T) {
+}
+
+func file(id, md5 string, size int64, created string) *lib.File {
+	return &lib.File{File: &drive.File{
+		Id:          id,
+		Title:       id,
+		Md5Checksum: md5,
+		FileSize:    size,
+		CreatedDate: created,
+	}}
+}
+
+func TestGroup(t *testing.T) {
+	files := []*lib.File{
+		file("a1", "aaa", 10, "2020-01-03T00:00:00.000Z"),
+		file("a2", "aaa", 10, "2020-01-01T00:00:00.000Z"),
+		file("a3", "aaa", 10, "2020-01-02T00:00:00.000Z"),
+		file("a2", "aaa", 10, "2020-01-01T00:00:00.000Z"), // Same file in another folder.
+		file("b1", "bbb", 100, "2020-01-01T00:00:00.000Z"),
+		file("b2", "bbb", 100, "2020-01-02T00:00:00.000Z"),
+		file("c1", "aaa", 11, "2020-01-01T00:00:00.000Z"), // Same md5, other size.
+		file("e1", "empty", 0, "2020-01-01T00:00:00.000Z"),
+		file("e2", "empty", 0, "2020-01-01T00:00:00.000Z"),
+		file("n1", "", 0, "2020-01-01T00:00:00.000Z"),
+		file("n2", "", 0, "2020-01-01T00:00:00.000Z"),
+	}
+	sets := group(files)
+	var got []string
+	for _, s := range sets {
+		var ids []string
+		for _, f := range s.files {
+			ids = append(ids, f.File.Id)
+		}
+		got = append(got, strings.Join(ids, ","))
+	}
+	if want := []string{"b1,b2", "a2,a3,a1"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if got, want := sets[1].wasted(), int64(20); got != want {
+		t.Errorf("wasted: got %d, want %d", got, want)
+	}
+	for _, test := range []struct {
+		keep string
+		want string
+	}{
+		{"oldest", "a3,a1"},
+		{"newest", "a2,a3"},
+	} {
+		var ids []string
+		for _, f := range sets[1].extra(test.keep) {
+			ids = append(ids, f.File.Id)
+		}
+		if got := strings.Join(ids, ","); got != test.want {
+			t.Errorf("extra(%q): got %q, want %q", test.keep, got, test.want)
+		}
+	}
+}
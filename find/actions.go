@@ -0,0 +1,181 @@
+package main
+
+/*
+ * This file contains the actions that change Drive or run commands.
+ */
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/ThomasHabets/drive-du/lib"
+)
+
+// Action names, as used in the summary.
+const (
+	actTrash   = "trashed"
+	actUntrash = "untrashed"
+	actMove    = "moved"
+	actLabel   = "labelled"
+	actExec    = "commands run"
+)
+
+// actor runs actions. With dryRun it only prints what it would have done.
+type actor struct {
+	ctx    context.Context
+	d      *drive.Service
+	w      io.Writer // Output of dry runs and commands.
+	dryRun bool
+
+	done   map[string]int // Successful actions, by name.
+	failed map[string]int // Failed actions, by name.
+}
+
+func newActor(ctx context.Context, d *drive.Service, w io.Writer, dryRun bool) *actor {
+	return &actor{
+		ctx:    ctx,
+		d:      d,
+		w:      w,
+		dryRun: dryRun,
+		done:   make(map[string]int),
+		failed: make(map[string]int),
+	}
+}
+
+// run runs f, or with dryRun prints what it would do. It returns true on
+// success, like find(1) -exec does for a zero exit status.
+func (a *actor) run(name, what string, f *lib.File, fn func() error) bool {
+	if a.dryRun {
+		fmt.Fprintf(a.w, "Would %s: %s (%s)\n", what, filePath(f), f.File.Id)
+		a.done[name]++
+		return true
+	}
+	if err := fn(); err != nil {
+		log.Printf("Failed to %s %q (%s): %v", what, filePath(f), f.File.Id, err)
+		a.failed[name]++
+		return false
+	}
+	a.done[name]++
+	return true
+}
+
+func (a *actor) trash(f *lib.File) bool {
+	return a.run(actTrash, "trash", f, func() error {
+		return lib.Retry(a.ctx, fmt.Sprintf("Files.Trash(%s)", f.File.Id), func() error {
+			_, err := a.d.Files.Trash(f.File.Id).Fields("id").Context(a.ctx).Do()
+			return err
+		})
+	})
+}
+
+func (a *actor) untrash(f *lib.File) bool {
+	return a.run(actUntrash, "untrash", f, func() error {
+		return lib.Retry(a.ctx, fmt.Sprintf("Files.Untrash(%s)", f.File.Id), func() error {
+			_, err := a.d.Files.Untrash(f.File.Id).Fields("id").Context(a.ctx).Do()
+			return err
+		})
+	})
+}
+
+// moveTo returns an action moving files to a folder, out of all their
+// current folders.
+func (a *actor) moveTo(folder string) expr {
+	return func(f *lib.File) bool {
+		return a.run(actMove, "move to "+folder, f, func() error {
+			var old []string
+			for _, p := range f.File.Parents {
+				if p.Id != folder {
+					old = append(old, p.Id)
+				}
+			}
+			return lib.Retry(a.ctx, fmt.Sprintf("Files.Patch(%s)", f.File.Id), func() error {
+				_, err := a.d.Files.Patch(f.File.Id, &drive.File{}).
+					AddParents(folder).
+					RemoveParents(strings.Join(old, ",")).
+					Fields("id").
+					Context(a.ctx).
+					Do()
+				return err
+			})
+		})
+	}
+}
+
+// addLabel returns an action setting a label. Only labels that users can
+// set are supported.
+func (a *actor) addLabel(label string) (expr, error) {
+	var l drive.FileLabels
+	switch label {
+	case "starred":
+		l.Starred = true
+	case "restricted":
+		l.Restricted = true
+	default:
+		return nil, fmt.Errorf("unsupported label %q, want starred or restricted", label)
+	}
+	return func(f *lib.File) bool {
+		return a.run(actLabel, "add label "+label+" to", f, func() error {
+			return lib.Retry(a.ctx, fmt.Sprintf("Files.Patch(%s)", f.File.Id), func() error {
+				_, err := a.d.Files.Patch(f.File.Id, &drive.File{Labels: &l}).Fields("id").Context(a.ctx).Do()
+				return err
+			})
+		})
+	}, nil
+}
+
+// exec returns an action running a local command. In every argument "{}"
+// is replaced with the path and "{id}" with the file ID.
+func (a *actor) exec(args []string) expr {
+	return func(f *lib.File) bool {
+		r := strings.NewReplacer("{id}", f.File.Id, "{}", filePath(f))
+		var argv []string
+		for _, s := range args {
+			argv = append(argv, r.Replace(s))
+		}
+		return a.run(actExec, "run "+strings.Join(argv, " ")+" for", f, func() error {
+			cmd := exec.CommandContext(a.ctx, argv[0], argv[1:]...)
+			cmd.Stdin = os.Stdin
+			cmd.Stdout = a.w
+			cmd.Stderr = os.Stderr
+			return cmd.Run()
+		})
+	}
+}
+
+// summary writes the number of actions done and failed.
+func (a *actor) summary(w io.Writer) {
+	if len(a.done)+len(a.failed) == 0 {
+		return
+	}
+	names := make(map[string]bool)
+	for k := range a.done {
+		names[k] = true
+	}
+	for k := range a.failed {
+		names[k] = true
+	}
+	var lines []string
+	for k := range names {
+		s := fmt.Sprintf("%d %s", a.done[k], k)
+		if a.dryRun {
+			s = fmt.Sprintf("%d would be %s", a.done[k], k)
+			if k == actExec {
+				s = fmt.Sprintf("%d commands would be run", a.done[k])
+			}
+		}
+		if n := a.failed[k]; n > 0 {
+			s += fmt.Sprintf(", %d failed", n)
+		}
+		lines = append(lines, s)
+	}
+	sort.Strings(lines)
+	fmt.Fprintf(w, "Summary: %s\n", strings.Join(lines, "; "))
+}
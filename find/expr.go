@@ -0,0 +1,462 @@
+package main
+
+/*
+ * This file contains the find(1)-like expression language.
+ *
+ * Grammar, loosest binding first:
+ *   expr    = and { ( "-or" | "-o" ) and }
+ *   and     = not { [ "-and" | "-a" ] not }
+ *   not     = ( "-not" | "!" ) not | primary
+ *   primary = "(" expr ")" | test | action
+ *
+ * Like find(1), an expression without actions prints matching files.
+ */
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/ThomasHabets/drive-du/lib"
+)
+
+// expr is a parsed expression, true if a file matches.
+type expr func(*lib.File) bool
+
+// query is a parsed expression.
+type query struct {
+	match   expr
+	actions bool // True if the expression has any actions of its own.
+	writes  bool // True if any action changes Drive.
+}
+
+// parser parses an expression from command line arguments.
+type parser struct {
+	args []string
+	now  time.Time // Reference time for -mtime and -ctime.
+	w    io.Writer // Output of print actions.
+	act  *actor    // Runs all other actions.
+	q    query
+}
+
+// parseExpr parses args into an expression that runs actions, writing any
+// output to w. If the expression has no actions of its own matching files
+// are printed.
+func parseExpr(args []string, now time.Time, w io.Writer, act *actor) (*query, error) {
+	p := &parser{args: args, now: now, w: w, act: act}
+	p.q.match = func(*lib.File) bool { return true }
+	if len(args) > 0 {
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if len(p.args) > 0 {
+			return nil, fmt.Errorf("unexpected %q", p.args[0])
+		}
+		p.q.match = e
+	}
+	if !p.q.actions {
+		p.q.match = andExpr(p.q.match, printExpr(w, "\n"))
+	}
+	return &p.q, nil
+}
+
+// peek returns the next argument, or "" at the end.
+func (p *parser) peek() string {
+	if len(p.args) == 0 {
+		return ""
+	}
+	return p.args[0]
+}
+
+// next consumes and returns the next argument.
+func (p *parser) next() (string, error) {
+	if len(p.args) == 0 {
+		return "", fmt.Errorf("unexpected end of expression")
+	}
+	a := p.args[0]
+	p.args = p.args[1:]
+	return a, nil
+}
+
+func (p *parser) or() (expr, error) {
+	l, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "-or" || p.peek() == "-o" {
+		p.next()
+		r, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l = orExpr(l, r)
+	}
+	return l, nil
+}
+
+func orExpr(l, r expr) expr {
+	return func(f *lib.File) bool { return l(f) || r(f) }
+}
+
+func (p *parser) and() (expr, error) {
+	l, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek() {
+		case "-and", "-a":
+			p.next()
+		case "", "-or", "-o", ")":
+			return l, nil
+		}
+		r, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		l = andExpr(l, r)
+	}
+}
+
+func andExpr(l, r expr) expr {
+	return func(f *lib.File) bool { return l(f) && r(f) }
+}
+
+func (p *parser) not() (expr, error) {
+	if p.peek() == "-not" || p.peek() == "!" {
+		p.next()
+		e, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(f *lib.File) bool { return !e(f) }, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (expr, error) {
+	a, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if a == "(" {
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if a, err := p.next(); err != nil || a != ")" {
+			return nil, fmt.Errorf("missing \")\"")
+		}
+		return e, nil
+	}
+
+	// Tests without arguments.
+	switch a {
+	case "-shared":
+		return func(f *lib.File) bool { return f.File.Shared }, nil
+	case "-starred":
+		return func(f *lib.File) bool { return f.File.Labels != nil && f.File.Labels.Starred }, nil
+	case "-trashed":
+		return func(f *lib.File) bool { return f.File.Labels != nil && f.File.Labels.Trashed }, nil
+	case "-print":
+		p.q.actions = true
+		return printExpr(p.w, "\n"), nil
+	case "-print0":
+		p.q.actions = true
+		return printExpr(p.w, "\x00"), nil
+	case "-trash":
+		p.q.actions, p.q.writes = true, true
+		return p.act.trash, nil
+	case "-untrash":
+		p.q.actions, p.q.writes = true, true
+		return p.act.untrash, nil
+	case "-exec":
+		p.q.actions = true
+		var args []string
+		for {
+			v, err := p.next()
+			if err != nil {
+				return nil, fmt.Errorf("-exec: missing \";\"")
+			}
+			if v == ";" {
+				break
+			}
+			args = append(args, v)
+		}
+		if len(args) == 0 {
+			return nil, fmt.Errorf("-exec: missing command")
+		}
+		return p.act.exec(args), nil
+	}
+
+	// Tests with one argument.
+	var parse func(string) (expr, error)
+	switch a {
+	case "-name":
+		parse = func(v string) (expr, error) { return globExpr(v, false) }
+	case "-iname":
+		parse = func(v string) (expr, error) { return globExpr(v, true) }
+	case "-regex":
+		parse = regexExpr
+	case "-mimetype":
+		parse = mimeExpr
+	case "-size":
+		parse = sizeExpr
+	case "-mtime":
+		parse = func(v string) (expr, error) {
+			return p.ageExpr(v, func(f *lib.File) string { return f.File.ModifiedDate })
+		}
+	case "-ctime":
+		// Drive has no inode change time, so use the creation time.
+		parse = func(v string) (expr, error) {
+			return p.ageExpr(v, func(f *lib.File) string { return f.File.CreatedDate })
+		}
+	case "-owner":
+		parse = ownerExpr
+	case "-printf":
+		p.q.actions = true
+		parse = func(v string) (expr, error) { return printfExpr(p.w, v) }
+	case "-move-to":
+		p.q.actions, p.q.writes = true, true
+		parse = func(v string) (expr, error) { return p.act.moveTo(v), nil }
+	case "-add-label":
+		p.q.actions, p.q.writes = true, true
+		parse = p.act.addLabel
+	default:
+		return nil, fmt.Errorf("unknown predicate or action %q", a)
+	}
+	v, err := p.next()
+	if err != nil {
+		return nil, fmt.Errorf("%s: missing argument", a)
+	}
+	e, err := parse(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", a, err)
+	}
+	return e, nil
+}
+
+// printExpr prints the path followed by end.
+func printExpr(w io.Writer, end string) expr {
+	return func(f *lib.File) bool {
+		fmt.Fprint(w, filePath(f), end)
+		return true
+	}
+}
+
+// printfExpr prints a line formatted like find(1) -printf. Directives:
+//
+//	%p path     %f title          %h folder path  %i ID
+//	%s size     %m MIME type      %u owner emails %l web view link
+//	%t modified %c created        %5 md5Checksum  %% a percent sign
+//
+// and the escapes \n, \t, \0 and \\.
+func printfExpr(w io.Writer, format string) (expr, error) {
+	// Check the format up front, so that typos fail before listing.
+	if _, err := printf(format, &lib.File{File: &drive.File{}}); err != nil {
+		return nil, err
+	}
+	return func(f *lib.File) bool {
+		s, _ := printf(format, f)
+		io.WriteString(w, s)
+		return true
+	}, nil
+}
+
+// printf formats a file for -printf.
+func printf(format string, f *lib.File) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' && c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		if i+1 == len(format) {
+			return "", fmt.Errorf("format ends with %q", c)
+		}
+		i++
+		if c == '\\' {
+			switch format[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case '0':
+				b.WriteByte(0)
+			case '\\':
+				b.WriteByte('\\')
+			default:
+				return "", fmt.Errorf("unknown escape \\%c", format[i])
+			}
+			continue
+		}
+		switch format[i] {
+		case 'p':
+			b.WriteString(filePath(f))
+		case 'f':
+			b.WriteString(f.File.Title)
+		case 'h':
+			if len(f.Path) == 0 {
+				b.WriteString(".")
+			} else {
+				b.WriteString(strings.Join(f.Path, "/"))
+			}
+		case 'i':
+			b.WriteString(f.File.Id)
+		case 's':
+			b.WriteString(strconv.FormatInt(f.File.FileSize, 10))
+		case 'm':
+			b.WriteString(f.File.MimeType)
+		case 'u':
+			var o []string
+			for _, u := range f.File.Owners {
+				o = append(o, u.EmailAddress)
+			}
+			b.WriteString(strings.Join(o, ","))
+		case 'l':
+			// alternateLink is what the v3 API calls webViewLink.
+			b.WriteString(f.File.AlternateLink)
+		case 't':
+			b.WriteString(f.File.ModifiedDate)
+		case 'c':
+			b.WriteString(f.File.CreatedDate)
+		case '5':
+			b.WriteString(f.File.Md5Checksum)
+		case '%':
+			b.WriteByte('%')
+		default:
+			return "", fmt.Errorf("unknown directive %%%c", format[i])
+		}
+	}
+	return b.String(), nil
+}
+
+// filePath returns the path of a file, relative to the folder being searched.
+func filePath(f *lib.File) string {
+	return strings.Join(append(append([]string(nil), f.Path...), f.File.Title), "/")
+}
+
+// globExpr matches the title against a shell pattern.
+func globExpr(pattern string, fold bool) (expr, error) {
+	if fold {
+		pattern = strings.ToLower(pattern)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	return func(f *lib.File) bool {
+		t := f.File.Title
+		if fold {
+			t = strings.ToLower(t)
+		}
+		ok, _ := path.Match(pattern, t)
+		return ok
+	}, nil
+}
+
+// regexExpr matches the whole path against a regular expression, like
+// find(1).
+func regexExpr(re string) (expr, error) {
+	r, err := regexp.Compile("^(?:" + re + ")$")
+	if err != nil {
+		return nil, err
+	}
+	return func(f *lib.File) bool { return r.MatchString(filePath(f)) }, nil
+}
+
+// mimeExpr matches the MIME type against a shell pattern, e.g. "image/*".
+func mimeExpr(pattern string) (expr, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	return func(f *lib.File) bool {
+		ok, _ := path.Match(pattern, f.File.MimeType)
+		return ok
+	}, nil
+}
+
+// parseCmp splits "+N", "-N" or "N" into a comparison sign and the rest.
+func parseCmp(s string) (int, string) {
+	switch {
+	case strings.HasPrefix(s, "+"):
+		return 1, s[1:]
+	case strings.HasPrefix(s, "-"):
+		return -1, s[1:]
+	}
+	return 0, s
+}
+
+// cmp returns true if v compares to n the way sign says.
+func cmp(sign int, v, n int64) bool {
+	switch sign {
+	case 1:
+		return v > n
+	case -1:
+		return v < n
+	}
+	return v == n
+}
+
+// sizeExpr compares the file size, rounded up to the unit, like find(1).
+// Units are c (bytes, the default), k, M and G, in powers of 1024.
+func sizeExpr(s string) (expr, error) {
+	sign, s := parseCmp(s)
+	unit := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'c':
+			s = s[:len(s)-1]
+		case 'k':
+			unit, s = 1<<10, s[:len(s)-1]
+		case 'M':
+			unit, s = 1<<20, s[:len(s)-1]
+		case 'G':
+			unit, s = 1<<30, s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad size %q", s)
+	}
+	return func(f *lib.File) bool {
+		return cmp(sign, (f.File.FileSize+unit-1)/unit, n)
+	}, nil
+}
+
+// ageExpr compares the age in whole days of the time returned by field.
+func (p *parser) ageExpr(s string, field func(*lib.File) string) (expr, error) {
+	sign, s := parseCmp(s)
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad number of days %q", s)
+	}
+	now := p.now
+	return func(f *lib.File) bool {
+		t, err := time.Parse(time.RFC3339Nano, field(f))
+		if err != nil {
+			return false
+		}
+		return cmp(sign, int64(now.Sub(t)/(24*time.Hour)), n)
+	}, nil
+}
+
+// ownerExpr matches any owner by email address. "me" matches files owned
+// by the authenticated user.
+func ownerExpr(email string) (expr, error) {
+	return func(f *lib.File) bool {
+		for _, o := range f.File.Owners {
+			if (email == "me" && o.IsAuthenticatedUser) || strings.EqualFold(o.EmailAddress, email) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
@@ -1,13 +1,22 @@
+// find is meant to be something like the unix binary find.
+//
+// Configure with:  ./find -config find.json -configure
+// Then run with:   ./find -config find.json 0x_XXXXNNNNAAAABBB [expression]
+// e.g. expression: -iname '*.jpg' -size +10M -not -owner me
+//
+// Actions that change Drive, like -trash, need -write, also when configuring.
 package main
 
 import (
-	"encoding/json"
+	"bufio"
+	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"os"
+	"time"
 
-	drive "code.google.com/p/google-api-go-client/drive/v2"
+	drive "google.golang.org/api/drive/v2"
 
 	"github.com/ThomasHabets/drive-du/lib"
 )
@@ -16,10 +25,23 @@ var (
 	config    = flag.String("config", "", "Config file.")
 	configure = flag.Bool("configure", false, "Configure oauth.")
 	workers   = flag.Int("workers", 10, "Number of Google API workers.")
+	qps       = flag.Float64("qps", 0, "Most Google API requests per second, for all workers together. 0 is unlimited.")
+	bwlimit   = flag.String("bwlimit", "", "Most bytes per second downloaded and uploaded, e.g. \"10M\". Empty is unlimited.")
+	cacheFile = flag.String("cache", "", "Cache file, to speed up repeated runs.")
+	snapshot  = flag.String("snapshot", "", "Snapshot file. If set, only changes since the last run are fetched.")
+	write     = flag.Bool("write", false, "Use read-write access, for -trash, -untrash, -move-to and -add-label.")
+	dryRun    bool
 )
 
+func init() {
+	const usage = "Only print what actions would do."
+	flag.BoolVar(&dryRun, "n", false, usage)
+	flag.BoolVar(&dryRun, "dry-run", false, usage)
+}
+
 const (
 	scope      = "https://www.googleapis.com/auth/drive.readonly.metadata"
+	writeScope = "https://www.googleapis.com/auth/drive"
 	accessType = "offline"
 )
 
@@ -29,29 +51,70 @@ func main() {
 		log.Fatalf("-config required")
 	}
 
+	sc := scope
+	if *write {
+		sc = writeScope
+	}
 	if *configure {
-		if err := lib.ConfigureWrite(scope, accessType, *config); err != nil {
+		if err := lib.ConfigureWrite(sc, accessType, *config); err != nil {
 			log.Fatal(err)
 		}
 		return
 	}
 
+	if flag.NArg() < 1 {
+		log.Fatalf("Usage: %s [flags] <folder ID> [expression]", os.Args[0])
+	}
+	out := bufio.NewWriter(os.Stdout)
+	act := newActor(context.Background(), nil, out, dryRun)
+	q, err := parseExpr(flag.Args()[1:], time.Now(), out, act)
+	if err != nil {
+		log.Fatalf("Bad expression: %v", err)
+	}
+	if q.writes && !*write && !dryRun {
+		log.Fatalf("Actions that change files need -write, and a config made with -configure -write")
+	}
+
 	conf, err := lib.ReadConfig(*config)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	t, err := lib.Connect(conf.OAuth, scope, accessType)
+	limits, err := lib.ParseLimits(*qps, *bwlimit)
+	if err != nil {
+		log.Fatalf("-bwlimit: %v", err)
+	}
+	t, err := lib.Connect(conf.OAuth, sc, accessType)
 	if err != nil {
 		log.Fatal(err)
 	}
-	d, err := drive.New(t.Client())
+	d, err := drive.New(limits.Client(t))
 	if err != nil {
 		log.Fatal(err)
 	}
+	act.d = d
 
+	opts := &lib.ListOptions{Workers: *workers}
+	// Trashed files are only interesting if asked for.
+	for _, a := range flag.Args()[1:] {
+		if a == "-trashed" || a == "-untrash" {
+			opts.IncludeTrashed = true
+		}
+	}
+	if *cacheFile != "" {
+		if opts.Cache, err = lib.OpenCache(*cacheFile); err != nil {
+			log.Fatal(err)
+		}
+	}
 	ch := make(chan *lib.File)
-	go lib.ListRecursive(d, *workers, ch, flag.Args()[0])
+	errCh := make(chan error, 1)
+	go func() {
+		if *snapshot != "" {
+			errCh <- lib.ListSnapshot(context.Background(), d, ch, flag.Args()[0], *snapshot, opts)
+		} else {
+			errCh <- lib.ListRecursiveContext(context.Background(), d, ch, flag.Args()[0], opts)
+		}
+	}()
 	var size int64
 	seen := make(map[string]bool)
 	for e := range ch {
@@ -59,8 +122,25 @@ func main() {
 			continue
 		}
 		seen[e.File.Id] = true
-		fmt.Println(e.Path, e.File.Title)
-		size += e.File.FileSize
+		if q.match(e) {
+			size += e.File.FileSize
+		}
+	}
+	if err := <-errCh; err != nil {
+		log.Fatal(err)
+	}
+	if opts.Cache != nil {
+		if err := opts.Cache.Save(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// The total would get in the way of explicit -print0 or -printf output.
+	if !q.actions {
+		fmt.Fprintln(out, "Total size: ", size)
+	}
+	if err := out.Flush(); err != nil {
+		log.Fatal(err)
 	}
-	fmt.Println("Total size: ", size)
+	// The summary goes to stderr, to not get mixed up with -print0 output.
+	act.summary(os.Stderr)
 }
@@ -1,8 +1,234 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
 	"testing"
+	"time"
+
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/ThomasHabets/drive-du/lib"
+	"github.com/ThomasHabets/drive-du/lib/drivefake"
 )
 
 func TestBuilds(t *testing.T) {
 }
+
+func TestExpr(t *testing.T) {
+	now := time.Date(2020, 6, 10, 12, 0, 0, 0, time.UTC)
+	files := []*lib.File{
+		{Path: []string{"Photos"}, File: &drive.File{
+			Title:        "Beach.JPG",
+			MimeType:     "image/jpeg",
+			FileSize:     3 << 20,
+			ModifiedDate: "2020-06-09T10:00:00.000Z",
+			CreatedDate:  "2020-01-01T10:00:00.000Z",
+			Owners:       []*drive.User{{EmailAddress: "me@example.com", IsAuthenticatedUser: true}},
+			Labels:       &drive.FileLabels{Starred: true},
+		}},
+		{Path: []string{"Docs", "old"}, File: &drive.File{
+			Title:        "notes.txt",
+			MimeType:     "text/plain",
+			FileSize:     100,
+			ModifiedDate: "2019-06-09T10:00:00.000Z",
+			CreatedDate:  "2019-06-01T10:00:00.000Z",
+			Owners:       []*drive.User{{EmailAddress: "Other@example.com"}},
+			Shared:       true,
+			Labels:       &drive.FileLabels{Trashed: true},
+		}},
+	}
+	for _, test := range []struct {
+		expr string
+		want string // Titles of matching files.
+	}{
+		{"", "Beach.JPG,notes.txt"},
+		{"-name *.jpg", ""},
+		{"-iname *.jpg", "Beach.JPG"},
+		{"-regex Docs/.*", "notes.txt"},
+		{"-regex old/.*", ""},
+		{"-mimetype image/*", "Beach.JPG"},
+		{"-size +1M", "Beach.JPG"},
+		{"-size 3M", "Beach.JPG"},
+		{"-size -1k", ""},
+		{"-size -101c", "notes.txt"},
+		{"-mtime -2", "Beach.JPG"},
+		{"-mtime +30", "notes.txt"},
+		{"-ctime 161", "Beach.JPG"},
+		{"-owner me", "Beach.JPG"},
+		{"-owner other@example.com", "notes.txt"},
+		{"-shared", "notes.txt"},
+		{"-starred", "Beach.JPG"},
+		{"-trashed", "notes.txt"},
+		{"-not -trashed", "Beach.JPG"},
+		{"! -trashed", "Beach.JPG"},
+		{"-starred -or -shared", "Beach.JPG,notes.txt"},
+		{"-starred -o -shared -a -trashed", "Beach.JPG,notes.txt"},
+		{"-starred -shared", ""},
+		{"-starred -and -iname beach*", "Beach.JPG"},
+		{"( -starred -o -shared ) -size +1k", "Beach.JPG"},
+		{"-not ( -starred -o -shared )", ""},
+	} {
+		q, err := parseExpr(strings.Fields(test.expr), now, ioutil.Discard, nil)
+		if err != nil {
+			t.Errorf("%q: %v", test.expr, err)
+			continue
+		}
+		var got []string
+		for _, f := range files {
+			if q.match(f) {
+				got = append(got, f.File.Title)
+			}
+		}
+		if strings.Join(got, ",") != test.want {
+			t.Errorf("%q: got %q, want %q", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	for _, expr := range []string{
+		"-name",
+		"-bogus",
+		"( -starred",
+		"-starred )",
+		"-size +x",
+		"-mtime abc",
+		"-regex (",
+		"-starred -or",
+		"-not",
+		"-printf %z",
+		"-printf \\",
+		"-exec echo {}",
+		"-exec ;",
+		"-add-label trashed",
+		"-move-to",
+	} {
+		if _, err := parseExpr(strings.Fields(expr), time.Now(), ioutil.Discard, nil); err == nil {
+			t.Errorf("%q: want error", expr)
+		}
+	}
+}
+
+func TestPrint(t *testing.T) {
+	files := []*lib.File{
+		{Path: []string{"a b", "c"}, File: &drive.File{
+			Id:            "id1",
+			Title:         "my file",
+			MimeType:      "text/plain",
+			FileSize:      12,
+			Md5Checksum:   "abc",
+			AlternateLink: "https://drive.google.com/file/d/id1/view",
+			ModifiedDate:  "2020-06-09T10:00:00.000Z",
+			Owners:        []*drive.User{{EmailAddress: "x@example.com"}, {EmailAddress: "y@example.com"}},
+		}},
+		{File: &drive.File{Id: "id2", Title: "top"}},
+	}
+	for _, test := range []struct {
+		args    []string
+		actions bool
+		want    string
+	}{
+		{nil, false, "a b/c/my file\ntop\n"},
+		{[]string{"-print0"}, true, "a b/c/my file\x00top\x00"},
+		{[]string{"-size", "+1c", "-print"}, true, "a b/c/my file\n"},
+		{[]string{"-printf", `%i %s %m %u %t %5 %l\n`}, true,
+			"id1 12 text/plain x@example.com,y@example.com 2020-06-09T10:00:00.000Z abc https://drive.google.com/file/d/id1/view\n" +
+				"id2 0     \n"},
+		{[]string{"-printf", `%h|%f|%p%%\t\\\0`}, true, "a b/c|my file|a b/c/my file%\t\\\x00.|top|top%\t\\\x00"},
+	} {
+		var buf bytes.Buffer
+		q, err := parseExpr(test.args, time.Now(), &buf, nil)
+		if err != nil {
+			t.Fatalf("%q: %v", test.args, err)
+		}
+		if q.actions != test.actions {
+			t.Errorf("%q: got actions %v, want %v", test.args, q.actions, test.actions)
+		}
+		for _, f := range files {
+			q.match(f)
+		}
+		if got := buf.String(); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.args, got, test.want)
+		}
+	}
+}
+
+// run runs a find expression against a fake, and returns the output and summary.
+func run(t *testing.T, s *drivefake.Server, dryRun bool, args ...string) (string, string) {
+	var out, sum bytes.Buffer
+	act := newActor(context.Background(), s.Service(), &out, dryRun)
+	q, err := parseExpr(args, time.Now(), &out, act)
+	if err != nil {
+		t.Fatalf("%q: %v", args, err)
+	}
+	ch := make(chan *lib.File)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- lib.ListRecursiveContext(context.Background(), s.Service(), ch, "root", &lib.ListOptions{IncludeTrashed: true})
+	}()
+	// Like main, files moved to a folder not listed yet are only matched
+	// once.
+	seen := make(map[string]bool)
+	for f := range ch {
+		if seen[f.File.Id] {
+			continue
+		}
+		seen[f.File.Id] = true
+		q.match(f)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	act.summary(&sum)
+	return out.String(), sum.String()
+}
+
+func TestActions(t *testing.T) {
+	s := drivefake.New()
+	defer s.Close()
+	s.AddFolder("root", "My Drive")
+	s.AddFolder("a", "a", "root")
+	s.AddFile("f1", "f1.txt", "1", "root")
+	s.AddFile("f2", "f2.jpg", "22", "root")
+
+	out, sum := run(t, s, true, "-name", "*.txt", "-trash", "-o", "-add-label", "starred")
+	if got, want := out, "Would trash: f1.txt (f1)\nWould add label starred to: f2.jpg (f2)\n"; got != want {
+		t.Errorf("dry run output: got %q, want %q", got, want)
+	}
+	if got, want := sum, "Summary: 1 would be labelled; 1 would be trashed\n"; got != want {
+		t.Errorf("dry run summary: got %q, want %q", got, want)
+	}
+	if f := s.File("f1"); f.Labels.Trashed {
+		t.Errorf("dry run trashed file")
+	}
+
+	_, sum = run(t, s, false, "-name", "*.txt", "-trash", "-o", "-add-label", "starred", "-move-to", "a")
+	if got, want := sum, "Summary: 1 labelled; 1 moved; 1 trashed\n"; got != want {
+		t.Errorf("summary: got %q, want %q", got, want)
+	}
+	if f := s.File("f1"); !f.Labels.Trashed {
+		t.Errorf("f1 not trashed")
+	}
+	if f := s.File("f2"); !f.Labels.Starred || len(f.Parents) != 1 || f.Parents[0].Id != "a" {
+		t.Errorf("f2 not starred and moved: %+v %+v", f.Labels, f.Parents)
+	}
+
+	out, sum = run(t, s, false, "-trashed", "-untrash", "-exec", "echo", "{id}:{}", ";")
+	if got, want := out, "f1:f1.txt\n"; got != want {
+		t.Errorf("exec output: got %q, want %q", got, want)
+	}
+	if got, want := sum, "Summary: 1 commands run; 1 untrashed\n"; got != want {
+		t.Errorf("summary: got %q, want %q", got, want)
+	}
+	if f := s.File("f1"); f.Labels.Trashed {
+		t.Errorf("f1 not untrashed")
+	}
+
+	_, sum = run(t, s, false, "-name", "f1.txt", "-exec", "false", ";")
+	if got, want := sum, "Summary: 0 commands run, 1 failed\n"; got != want {
+		t.Errorf("summary: got %q, want %q", got, want)
+	}
+}
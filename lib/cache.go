@@ -0,0 +1,185 @@
+package lib
+
+/*
+ * This file contains an on-disk cache of folder listings.
+ */
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	drive "google.golang.org/api/drive/v2"
+)
+
+var (
+	// cacheSkew is how far back to look for changed folders, to allow for
+	// clock differences between us and Drive.
+	cacheSkew = time.Minute
+)
+
+// Cache is an on-disk cache of folder listings, keyed by folder ID.
+//
+// A cached folder listing is used if the folder's modifiedDate hasn't
+// changed since it was listed. Changes are found with a single query for
+// files and folders modified since the last scan, and trashed ones, which
+// are patched into the cached listings, so unchanged subtrees cost no API
+// calls at all.
+type Cache struct {
+	fn string
+
+	mutex sync.Mutex
+	data  cacheData
+}
+
+type cacheData struct {
+	// Roots is when each listing root was last fully scanned.
+	Roots map[string]time.Time
+
+	// Folders is the listing of each folder.
+	Folders map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	ModifiedDate string
+	Complete     bool // All pages have been stored.
+	Items        []*drive.File
+}
+
+// OpenCache loads the cache file fn. A missing file is an empty cache.
+func OpenCache(fn string) (*Cache, error) {
+	c := &Cache{
+		fn: fn,
+		data: cacheData{
+			Roots:   make(map[string]time.Time),
+			Folders: make(map[string]*cacheEntry),
+		},
+	}
+	if err := loadGob(fn, &c.data); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Save writes the cache back to disk.
+func (c *Cache) Save() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return saveGob(c.fn, &c.data)
+}
+
+func loadGob(fn string, v interface{}) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return gob.NewDecoder(f).Decode(v)
+}
+
+// saveGob atomically replaces fn with v gob-encoded.
+func saveGob(fn string, v interface{}) error {
+	f, err := ioutil.TempFile(filepath.Dir(fn), filepath.Base(fn)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := gob.NewEncoder(f).Encode(v); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fn)
+}
+
+// scanned returns when root was last fully scanned.
+func (c *Cache) scanned(root string) (time.Time, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t, ok := c.data.Roots[root]
+	return t, ok
+}
+
+func (c *Cache) setScanned(root string, t time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.data.Roots[root] = t
+}
+
+// get returns the cached listing of folder id. If modified is non-empty it
+// must match the cached modifiedDate.
+func (c *Cache) get(id, modified string) ([]*drive.File, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.data.Folders[id]
+	if !ok || !e.Complete {
+		return nil, false
+	}
+	if modified != "" && modified != e.ModifiedDate {
+		return nil, false
+	}
+	return e.Items, true
+}
+
+// put stores one page of the listing of folder id. The first page replaces
+// any old listing.
+func (c *Cache) put(id, page, modified string, items []*drive.File, last bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.data.Folders[id]
+	if !ok || page == "" {
+		e = &cacheEntry{ModifiedDate: modified}
+		c.data.Folders[id] = e
+	}
+	e.Items = append(e.Items, items...)
+	e.Complete = last
+}
+
+// apply patches all cached listings with changed files. Changed files
+// replace the cached ones, or are added or removed if their parents changed.
+// Cached files that are trashed but not in the trash any more were
+// restored.
+func (c *Cache) apply(cs *changeSet) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for id, e := range c.data.Folders {
+		var items []*drive.File
+		seen := make(map[string]bool)
+		for _, f := range e.Items {
+			if n, ok := cs.files[f.Id]; ok {
+				if !hasParent(n, id) {
+					continue
+				}
+				f = n
+			} else if f.Labels != nil && f.Labels.Trashed {
+				r := *f
+				l := *f.Labels
+				l.Trashed = false
+				r.Labels, r.ExplicitlyTrashed = &l, false
+				f = &r
+			}
+			seen[f.Id] = true
+			items = append(items, f)
+		}
+		for _, f := range cs.files {
+			if !seen[f.Id] && hasParent(f, id) {
+				items = append(items, f)
+			}
+		}
+		e.Items = items
+	}
+}
+
+func hasParent(f *drive.File, id string) bool {
+	for _, p := range f.Parents {
+		if p.Id == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	old := cacheSkew
+	cacheSkew = 0
+	defer func() { cacheSkew = old }()
+
+	dir, err := ioutil.TempDir("", "drive-du-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "cache")
+
+	s := tree()
+	defer s.Close()
+
+	// scan lists root with a freshly loaded cache, and returns the files
+	// with their sizes, and number of Files.List calls made.
+	scan := func() ([]string, int) {
+		c, err := OpenCache(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := s.Calls("Files.List")
+		ch := make(chan *File)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- ListRecursiveContext(context.Background(), s.Service(), ch, "root", &ListOptions{Cache: c})
+		}()
+		var got []string
+		for f := range ch {
+			got = append(got, fmt.Sprintf("%s=%d", strings.Join(append(append([]string(nil), f.Path...), f.File.Title), "/"), f.File.FileSize))
+		}
+		sort.Strings(got)
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Save(); err != nil {
+			t.Fatal(err)
+		}
+		return got, s.Calls("Files.List") - before
+	}
+
+	got, calls := scan()
+	if want := []string{"a/b/f3=3", "a/f2=2", "f1=1"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("first scan: got %q, want %q", got, want)
+	}
+	if want := 3; calls != want {
+		t.Errorf("first scan: got %d list calls, want %d", calls, want)
+	}
+
+	// Nothing changed, so only the query for changes is needed.
+	got, calls = scan()
+	if want := []string{"a/b/f3=3", "a/f2=2", "f1=1"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("second scan: got %q, want %q", got, want)
+	}
+	if want := 1; calls != want {
+		t.Errorf("second scan: got %d list calls, want %d", calls, want)
+	}
+
+	// A new file deep down only causes its folder to be listed again.
+	s.AddFile("f4", "f4", "4444", "b")
+	got, calls = scan()
+	if want := []string{"a/b/f3=3", "a/b/f4=4", "a/f2=2", "f1=1"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("third scan: got %q, want %q", got, want)
+	}
+	if want := 2; calls != want {
+		t.Errorf("third scan: got %d list calls, want %d", calls, want)
+	}
+
+	// Changed and trashed files don't change their folder's modifiedDate,
+	// but are still seen without listing the folder again.
+	s.AddFile("f3", "f3", "33333", "b")
+	if _, err := s.Service().Files.Trash("f2").Do(); err != nil {
+		t.Fatal(err)
+	}
+	got, calls = scan()
+	if want := []string{"a/b/f3=5", "a/b/f4=4", "f1=1"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("fourth scan: got %q, want %q", got, want)
+	}
+	if want := 1; calls != want {
+		t.Errorf("fourth scan: got %d list calls, want %d", calls, want)
+	}
+
+	// A file restored from the trash is counted again.
+	if _, err := s.Service().Files.Untrash("f2").Do(); err != nil {
+		t.Fatal(err)
+	}
+	got, calls = scan()
+	if want := []string{"a/b/f3=5", "a/b/f4=4", "a/f2=2", "f1=1"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("fifth scan: got %q, want %q", got, want)
+	}
+	if want := 1; calls != want {
+		t.Errorf("fifth scan: got %d list calls, want %d", calls, want)
+	}
+}
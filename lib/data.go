@@ -10,6 +10,22 @@ func (s Size) Pretty() string {
 	return Pretty(int64(s))
 }
 
+// Format formats the size in the given units, with precision digits after
+// the decimal point.
+func (s Size) Format(u Units, precision int) string {
+	return HumanSize(int64(s), u, precision)
+}
+
+// Binary formats the size in KiB, MiB, etc.
+func (s Size) Binary() string {
+	return s.Format(UnitsBinary, 1)
+}
+
+// SI formats the size in kB, MB, etc.
+func (s Size) SI() string {
+	return s.Format(UnitsSI, 1)
+}
+
 type SizeEntry struct {
 	Key   string
 	Value Size
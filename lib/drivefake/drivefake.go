@@ -0,0 +1,987 @@
+// Package drivefake is an in-memory fake of the Google Drive v2 API, for
+// hermetic tests.
+//
+// Build a tree with Add, AddFolder and AddFile, then talk to it with
+// drive.New(s.Client()). All requests to https://www.googleapis.com/ made
+// through that client are served by the fake.
+package drivefake
+
+/*
+ * This file contains the fake server and its fixture API.
+ */
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	drive "google.golang.org/api/drive/v2"
+)
+
+const (
+	// Me is the email address of the user the fake is authenticated as.
+	// Inserted files are owned by this user.
+	Me = "me@example.com"
+
+	folderMime      = "application/vnd.google-apps.folder"
+	defaultPageSize = 100
+	apiHost         = "www.googleapis.com"
+)
+
+var (
+	parentsRE = regexp.MustCompile(`'([^']+)' in parents`)
+	queryRE   = regexp.MustCompile(`^\s*'([^']+)' in parents\s*(and\s+trashed\s*=\s*false)?\s*$`)
+	changedRE = regexp.MustCompile(`^\s*modifiedDate\s*>\s*'([^']+)'\s+or\s+trashed\s*=\s*true\s*$`)
+)
+
+// Fault is an error to inject into API calls.
+type Fault struct {
+	Op     string // API call to fail, e.g. "Files.Get". Empty matches all calls.
+	ID     string // File ID to fail. Empty matches all IDs.
+	Code   int    // HTTP status code to return.
+	Reason string // Error reason, e.g. "userRateLimitExceeded".
+	Times  int    // Number of times to fail. Negative means forever.
+}
+
+// Server is a fake Drive v2 API server.
+type Server struct {
+	// PageSize is the maximum number of items returned per list page, if
+	// the client asks for more or doesn't say.
+	PageSize int
+
+	srv *httptest.Server
+
+	mutex   sync.Mutex
+	files   map[string]*drive.File
+	content map[string][]byte
+	order   []string
+	faults  []*Fault
+	calls   map[string]int
+	nextID  int
+
+	// perms has the permissions of each file, including the owner's.
+	perms map[string][]*drive.Permission
+
+	// revisions has the old revisions of each file, oldest first. The
+	// head revision is not included.
+	revisions map[string][]*drive.Revision
+
+	// changes is the ID of every changed file, in order. Change tokens are
+	// indexes into it.
+	changes []string
+
+	// uploads has the resumable uploads in progress, by upload ID.
+	uploads map[string]*upload
+}
+
+// upload is a resumable upload in progress.
+type upload struct {
+	meta    *drive.File
+	content []byte
+}
+
+// New starts a new fake server. Close it when done.
+func New() *Server {
+	s := &Server{
+		PageSize: defaultPageSize,
+		files:    make(map[string]*drive.File),
+		content:  make(map[string][]byte),
+		calls:    make(map[string]int),
+
+		revisions: make(map[string][]*drive.Revision),
+		perms:     make(map[string][]*drive.Permission),
+		uploads:   make(map[string]*upload),
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// URL returns the base URL of the server.
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// Client returns an HTTP client that sends all Google API requests to the
+// fake server.
+func (s *Server) Client() *http.Client {
+	u, _ := url.Parse(s.srv.URL)
+	return &http.Client{
+		Transport: &rewrite{
+			host: u.Host,
+			rt:   http.DefaultTransport,
+		},
+	}
+}
+
+// Service returns a Drive client talking to the fake server.
+func (s *Server) Service() *drive.Service {
+	d, err := drive.New(s.Client())
+	if err != nil {
+		// drive.New only fails on a nil client.
+		panic(err)
+	}
+	return d
+}
+
+// rewrite is a RoundTripper that redirects Google API requests to a local server.
+type rewrite struct {
+	host string
+	rt   http.RoundTripper
+}
+
+func (t *rewrite) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != apiHost {
+		return t.rt.RoundTrip(req)
+	}
+	r := new(http.Request)
+	*r = *req
+	u := *req.URL
+	u.Scheme = "http"
+	u.Host = t.host
+	r.URL = &u
+	r.Host = t.host
+	return t.rt.RoundTrip(r)
+}
+
+// Add adds a file to the fake, with optional content. FileSize, Md5Checksum
+// and DownloadUrl are filled in from content if non-nil. An ID is generated
+// if f.Id is empty. f is stored as-is, so don't change it afterwards.
+func (s *Server) Add(f *drive.File, content []byte) *drive.File {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.add(f, content)
+	return f
+}
+
+func (s *Server) add(f *drive.File, content []byte) {
+	if f.Id == "" {
+		s.nextID++
+		f.Id = fmt.Sprintf("fake-%d", s.nextID)
+	}
+	if f.Kind == "" {
+		f.Kind = "drive#file"
+	}
+	if f.Labels == nil {
+		f.Labels = &drive.FileLabels{}
+	}
+	if len(f.Owners) == 0 {
+		f.Owners = []*drive.User{{EmailAddress: Me, DisplayName: Me, IsAuthenticatedUser: true}}
+	}
+	if len(f.OwnerNames) == 0 {
+		for _, o := range f.Owners {
+			f.OwnerNames = append(f.OwnerNames, o.DisplayName)
+		}
+	}
+	if f.ModifiedDate == "" {
+		f.ModifiedDate = now()
+	}
+	if _, ok := s.perms[f.Id]; !ok {
+		for _, o := range f.Owners {
+			s.perms[f.Id] = append(s.perms[f.Id], s.newPerm("user", "owner", o.EmailAddress))
+		}
+	}
+	if content != nil {
+		sum := md5.Sum(content)
+		f.FileSize = int64(len(content))
+		f.Md5Checksum = hex.EncodeToString(sum[:])
+		f.DownloadUrl = fmt.Sprintf("https://%s/drive/v2/files/%s?alt=media", apiHost, f.Id)
+		f.HeadRevisionId = "head"
+		f.QuotaBytesUsed = f.FileSize
+		for _, r := range s.revisions[f.Id] {
+			f.QuotaBytesUsed += r.FileSize
+		}
+		s.content[f.Id] = content
+	}
+	if _, ok := s.files[f.Id]; !ok {
+		s.order = append(s.order, f.Id)
+		s.touchParents(f)
+	}
+	s.files[f.Id] = f
+	s.changes = append(s.changes, f.Id)
+}
+
+func (s *Server) newPerm(typ, role, email string) *drive.Permission {
+	s.nextID++
+	return &drive.Permission{
+		Kind:         "drive#permission",
+		Id:           fmt.Sprintf("perm-%d", s.nextID),
+		Type:         typ,
+		Role:         role,
+		EmailAddress: email,
+	}
+}
+
+// touchParents updates the modifiedDate of the parents of f, like Drive
+// does when files are added to or removed from a folder. Like Drive, it's
+// not done when a file in the folder is changed or trashed.
+func (s *Server) touchParents(f *drive.File) {
+	for _, p := range f.Parents {
+		if pf, ok := s.files[p.Id]; ok {
+			pf.ModifiedDate = now()
+		}
+	}
+}
+
+func now() string {
+	return time.Now().UTC().Format(time.RFC3339Nano)
+}
+
+// AddFolder adds a folder under the given parents.
+func (s *Server) AddFolder(id, title string, parents ...string) *drive.File {
+	return s.Add(&drive.File{
+		Id:       id,
+		Title:    title,
+		MimeType: folderMime,
+		Parents:  parentRefs(parents),
+	}, nil)
+}
+
+// AddFile adds a binary file with content under the given parents.
+func (s *Server) AddFile(id, title, content string, parents ...string) *drive.File {
+	return s.Add(&drive.File{
+		Id:       id,
+		Title:    title,
+		MimeType: "application/octet-stream",
+		Parents:  parentRefs(parents),
+	}, []byte(content))
+}
+
+func parentRefs(ids []string) []*drive.ParentReference {
+	var ret []*drive.ParentReference
+	for _, id := range ids {
+		ret = append(ret, &drive.ParentReference{Id: id})
+	}
+	return ret
+}
+
+// AddRevision adds an old revision with the given content to a file. The
+// file's QuotaBytesUsed includes old revisions, like in Drive.
+func (s *Server) AddRevision(id, content string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sum := md5.Sum([]byte(content))
+	s.revisions[id] = append(s.revisions[id], &drive.Revision{
+		Kind:         "drive#revision",
+		Id:           strconv.Itoa(len(s.revisions[id]) + 1),
+		FileSize:     int64(len(content)),
+		Md5Checksum:  hex.EncodeToString(sum[:]),
+		ModifiedDate: now(),
+	})
+	s.files[id].QuotaBytesUsed += int64(len(content))
+}
+
+// Move replaces the parents of a file.
+func (s *Server) Move(id string, parents ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f := s.files[id]
+	s.touchParents(f)
+	f.Parents = parentRefs(parents)
+	f.ModifiedDate = now()
+	s.touchParents(f)
+	s.changes = append(s.changes, id)
+}
+
+// Delete permanently deletes a file.
+func (s *Server) Delete(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.touchParents(s.files[id])
+	delete(s.files, id)
+	delete(s.content, id)
+	delete(s.perms, id)
+	for n, o := range s.order {
+		if o == id {
+			s.order = append(s.order[:n], s.order[n+1:]...)
+			break
+		}
+	}
+	s.changes = append(s.changes, id)
+}
+
+// File returns a copy of a file's metadata, or nil if it doesn't exist.
+func (s *Server) File(id string) *drive.File {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f, ok := s.files[id]
+	if !ok {
+		return nil
+	}
+	c := *f
+	return &c
+}
+
+// Content returns the content of a file.
+func (s *Server) Content(id string) []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.content[id]
+}
+
+// Permissions returns copies of the permissions of a file.
+func (s *Server) Permissions(id string) []*drive.Permission {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var ret []*drive.Permission
+	for _, p := range s.perms[id] {
+		c := *p
+		ret = append(ret, &c)
+	}
+	return ret
+}
+
+// AddPermission shares a file. For type "domain" email is the domain.
+func (s *Server) AddPermission(id, typ, role, email string) *drive.Permission {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	p := s.newPerm(typ, role, email)
+	if typ == "domain" {
+		p.EmailAddress, p.Domain = "", email
+	}
+	s.perms[id] = append(s.perms[id], p)
+	return p
+}
+
+// Children returns the IDs of all files with the given parent, in insertion order.
+func (s *Server) Children(parent string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var ret []string
+	for _, f := range s.children(parent) {
+		ret = append(ret, f.Id)
+	}
+	return ret
+}
+
+func (s *Server) children(parent string) []*drive.File {
+	var ret []*drive.File
+	for _, id := range s.order {
+		f := s.files[id]
+		for _, p := range f.Parents {
+			if p.Id == parent {
+				ret = append(ret, f)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// Inject makes future calls fail.
+func (s *Server) Inject(f Fault) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults = append(s.faults, &f)
+}
+
+// Calls returns the number of times op (e.g. "Files.Get") has been called,
+// including failed calls.
+func (s *Server) Calls(op string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.calls[op]
+}
+
+// fault returns the injected fault for a call, if any.
+func (s *Server) fault(op, id string) *Fault {
+	for _, f := range s.faults {
+		if f.Times == 0 {
+			continue
+		}
+		if (f.Op == "" || f.Op == op) && (f.ID == "" || f.ID == id) {
+			if f.Times > 0 {
+				f.Times--
+			}
+			return f
+		}
+	}
+	return nil
+}
+
+type errorItem struct {
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+type errorReply struct {
+	Error struct {
+		Code    int         `json:"code"`
+		Message string      `json:"message"`
+		Errors  []errorItem `json:"errors"`
+	} `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, code int, reason, msg string) {
+	var e errorReply
+	e.Error.Code = code
+	e.Error.Message = msg
+	e.Error.Errors = []errorItem{{Reason: reason, Message: msg}}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&e)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// route maps a request to an API call name and file ID.
+func route(r *http.Request) (op, id string) {
+	p := strings.TrimPrefix(r.URL.Path, "/upload")
+	p = strings.TrimPrefix(p, "/drive/v2/")
+	parts := strings.Split(p, "/")
+	switch {
+	case r.Method == "POST" && p == "files" && r.URL.Query().Get("upload_id") != "":
+		return "Files.Upload", r.URL.Query().Get("upload_id")
+	case r.Method == "POST" && p == "files":
+		return "Files.Insert", ""
+	case r.Method == "GET" && p == "changes/startPageToken":
+		return "Changes.GetStartPageToken", ""
+	case r.Method == "GET" && p == "changes":
+		return "Changes.List", ""
+	case r.Method == "GET" && p == "about":
+		return "About.Get", ""
+	case r.Method == "GET" && p == "files/generateIds":
+		return "Files.GenerateIds", ""
+	case r.Method == "GET" && p == "files":
+		// The folder ID from the query is used to match injected faults.
+		if m := parentsRE.FindStringSubmatch(r.FormValue("q")); m != nil {
+			return "Files.List", m[1]
+		}
+		return "Files.List", ""
+	case r.Method == "GET" && len(parts) == 2 && parts[0] == "files":
+		if r.FormValue("alt") == "media" {
+			return "Files.Download", parts[1]
+		}
+		return "Files.Get", parts[1]
+	case r.Method == "PATCH" && len(parts) == 2 && parts[0] == "files":
+		return "Files.Patch", parts[1]
+	case r.Method == "POST" && len(parts) == 3 && parts[0] == "files" && parts[2] == "trash":
+		return "Files.Trash", parts[1]
+	case r.Method == "POST" && len(parts) == 3 && parts[0] == "files" && parts[2] == "untrash":
+		return "Files.Untrash", parts[1]
+	case r.Method == "POST" && len(parts) == 3 && parts[0] == "files" && parts[2] == "copy":
+		return "Files.Copy", parts[1]
+	case r.Method == "POST" && len(parts) == 3 && parts[0] == "files" && parts[2] == "permissions":
+		return "Permissions.Insert", parts[1]
+	case r.Method == "GET" && len(parts) == 3 && parts[0] == "files" && parts[2] == "permissions":
+		return "Permissions.List", parts[1]
+	case r.Method == "GET" && len(parts) == 3 && parts[0] == "files" && parts[2] == "children":
+		return "Children.List", parts[1]
+	case r.Method == "GET" && len(parts) == 3 && parts[0] == "files" && parts[2] == "revisions":
+		return "Revisions.List", parts[1]
+	}
+	return "", ""
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	op, id := route(r)
+	if op == "" {
+		writeError(w, http.StatusNotFound, "notFound", fmt.Sprintf("no such API: %s %s", r.Method, r.URL.Path))
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls[op]++
+	if f := s.fault(op, id); f != nil {
+		writeError(w, f.Code, f.Reason, fmt.Sprintf("injected error for %s(%s)", op, id))
+		return
+	}
+
+	switch op {
+	case "Files.Insert":
+		s.insert(w, r)
+		return
+	case "Files.Upload":
+		s.uploadChunk(w, r, id)
+		return
+	case "Files.List":
+		s.listFiles(w, r)
+		return
+	case "Changes.GetStartPageToken":
+		writeJSON(w, &drive.StartPageToken{
+			Kind:           "drive#startPageToken",
+			StartPageToken: strconv.Itoa(len(s.changes)),
+		})
+		return
+	case "Changes.List":
+		s.listChanges(w, r)
+		return
+	case "About.Get":
+		writeJSON(w, &drive.About{
+			Kind: "drive#about",
+			Name: Me,
+			User: &drive.User{Kind: "drive#user", EmailAddress: Me, DisplayName: Me, IsAuthenticatedUser: true},
+		})
+		return
+	case "Files.GenerateIds":
+		n, err := strconv.Atoi(r.FormValue("maxResults"))
+		if err != nil || n <= 0 {
+			n = 10
+		}
+		ids := &drive.GeneratedIds{Kind: "drive#generatedIds", Space: "drive"}
+		for i := 0; i < n; i++ {
+			s.nextID++
+			ids.Ids = append(ids.Ids, fmt.Sprintf("generated-%d", s.nextID))
+		}
+		writeJSON(w, ids)
+		return
+	}
+
+	f, ok := s.files[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "notFound", fmt.Sprintf("File not found: %s", id))
+		return
+	}
+	switch op {
+	case "Files.Get":
+		writeJSON(w, f)
+	case "Files.Download":
+		c, ok := s.content[id]
+		if !ok {
+			writeError(w, http.StatusForbidden, "fileNotDownloadable", "File is not downloadable")
+			return
+		}
+		w.Header().Set("Content-Type", f.MimeType)
+		if rng := r.Header.Get("Range"); rng != "" {
+			var start int
+			if _, err := fmt.Sscanf(rng, "bytes=%d-", &start); err != nil || start > len(c) {
+				writeError(w, http.StatusRequestedRangeNotSatisfiable, "badRange", fmt.Sprintf("bad range %q", rng))
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(c)-1, len(c)))
+			w.WriteHeader(http.StatusPartialContent)
+			c = c[start:]
+		}
+		w.Write(c)
+	case "Files.Trash":
+		f.Labels.Trashed = true
+		f.ExplicitlyTrashed = true
+		s.changes = append(s.changes, id)
+		writeJSON(w, f)
+	case "Files.Untrash":
+		f.Labels.Trashed = false
+		f.ExplicitlyTrashed = false
+		s.changes = append(s.changes, id)
+		writeJSON(w, f)
+	case "Files.Patch":
+		s.patch(w, r, f)
+	case "Files.Copy":
+		s.copy(w, r, f)
+	case "Permissions.Insert":
+		s.insertPerm(w, r, f)
+	case "Permissions.List":
+		writeJSON(w, &drive.PermissionList{Kind: "drive#permissionList", Items: s.perms[id]})
+	case "Children.List":
+		s.listChildren(w, r, id)
+	case "Revisions.List":
+		s.listRevisions(w, r, f)
+	}
+}
+
+// page returns the page of n items selected by pageToken and maxResults,
+// and the token for the next page.
+func (s *Server) page(pageToken, maxResults string, n int) (start, end int, next string) {
+	size := s.PageSize
+	if size <= 0 {
+		size = defaultPageSize
+	}
+	if m, err := strconv.Atoi(maxResults); err == nil && m > 0 && m < size {
+		size = m
+	}
+	if pageToken != "" {
+		start, _ = strconv.Atoi(pageToken)
+	}
+	if start > n {
+		start = n
+	}
+	end = start + size
+	if end < n {
+		next = strconv.Itoa(end)
+	} else {
+		end = n
+	}
+	return start, end, next
+}
+
+func (s *Server) listChildren(w http.ResponseWriter, r *http.Request, id string) {
+	all := s.children(id)
+	start, end, next := s.page(r.FormValue("pageToken"), r.FormValue("maxResults"), len(all))
+	l := &drive.ChildList{
+		Kind:          "drive#childList",
+		NextPageToken: next,
+	}
+	for _, f := range all[start:end] {
+		l.Items = append(l.Items, &drive.ChildReference{
+			Kind: "drive#childReference",
+			Id:   f.Id,
+		})
+	}
+	writeJSON(w, l)
+}
+
+// listRevisions handles Revisions.List. The head revision is last, like in
+// Drive. Folders and files without content have no revisions.
+func (s *Server) listRevisions(w http.ResponseWriter, r *http.Request, f *drive.File) {
+	all := append([]*drive.Revision(nil), s.revisions[f.Id]...)
+	if f.HeadRevisionId != "" {
+		all = append(all, &drive.Revision{
+			Kind:         "drive#revision",
+			Id:           f.HeadRevisionId,
+			FileSize:     f.FileSize,
+			Md5Checksum:  f.Md5Checksum,
+			ModifiedDate: f.ModifiedDate,
+		})
+	}
+	start, end, next := s.page(r.FormValue("pageToken"), r.FormValue("maxResults"), len(all))
+	writeJSON(w, &drive.RevisionList{
+		Kind:          "drive#revisionList",
+		NextPageToken: next,
+		Items:         all[start:end],
+	})
+}
+
+// listFiles handles Files.List. The only supported queries are
+// "'<id>' in parents", optionally followed by "and trashed = false", and
+// "mimeType = '<type>' and modifiedDate > '<time>'".
+func (s *Server) listFiles(w http.ResponseWriter, r *http.Request) {
+	q := r.FormValue("q")
+	var all []*drive.File
+	if m := queryRE.FindStringSubmatch(q); m != nil {
+		for _, f := range s.children(m[1]) {
+			if m[2] != "" && f.Labels.Trashed {
+				continue
+			}
+			all = append(all, f)
+		}
+	} else if m := changedRE.FindStringSubmatch(q); m != nil {
+		since, err := time.Parse(time.RFC3339Nano, m[1])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalidQuery", fmt.Sprintf("bad time in query %q: %v", q, err))
+			return
+		}
+		for _, id := range s.order {
+			f := s.files[id]
+			t, _ := time.Parse(time.RFC3339Nano, f.ModifiedDate)
+			if t.After(since) || f.Labels.Trashed {
+				all = append(all, f)
+			}
+		}
+	} else {
+		writeError(w, http.StatusBadRequest, "invalidQuery", fmt.Sprintf("unsupported query %q", q))
+		return
+	}
+	start, end, next := s.page(r.FormValue("pageToken"), r.FormValue("maxResults"), len(all))
+	writeJSON(w, &drive.FileList{
+		Kind:          "drive#fileList",
+		NextPageToken: next,
+		Items:         all[start:end],
+	})
+}
+
+// listChanges handles Changes.List. Every change has the current state of
+// the file, like the real API.
+func (s *Server) listChanges(w http.ResponseWriter, r *http.Request) {
+	first, err := strconv.Atoi(r.FormValue("pageToken"))
+	if err != nil || first < 0 || first > len(s.changes) {
+		writeError(w, http.StatusBadRequest, "invalid", fmt.Sprintf("bad page token %q", r.FormValue("pageToken")))
+		return
+	}
+	all := s.changes[first:]
+	start, end, next := s.page("", r.FormValue("maxResults"), len(all))
+	l := &drive.ChangeList{Kind: "drive#changeList"}
+	for n, id := range all[start:end] {
+		c := &drive.Change{
+			Kind:   "drive#change",
+			Id:     int64(first + start + n),
+			FileId: id,
+		}
+		if f, ok := s.files[id]; ok {
+			c.File = f
+		} else {
+			c.Deleted = true
+		}
+		l.Items = append(l.Items, c)
+	}
+	if next != "" {
+		l.NextPageToken = strconv.Itoa(first + end)
+	} else {
+		l.NewStartPageToken = strconv.Itoa(len(s.changes))
+	}
+	writeJSON(w, l)
+}
+
+// patch handles Files.Patch. Fields in the request replace those in f,
+// and the addParents and removeParents parameters are supported.
+func (s *Server) patch(w http.ResponseWriter, r *http.Request, f *drive.File) {
+	var add []string
+	if p := r.FormValue("addParents"); p != "" {
+		add = strings.Split(p, ",")
+	}
+	for _, p := range add {
+		if _, ok := s.files[p]; !ok {
+			writeError(w, http.StatusNotFound, "notFound", fmt.Sprintf("File not found: %s", p))
+			return
+		}
+	}
+	// Decoding into a copy merges the request into the current state.
+	c := *f
+	if f.Labels != nil {
+		l := *f.Labels
+		c.Labels = &l
+	}
+	if err := decodeOnto(r.Body, &c, f); err != nil {
+		writeError(w, http.StatusBadRequest, "parseError", fmt.Sprintf("parsing metadata: %v", err))
+		return
+	}
+	c.Id = f.Id
+	moved := len(add) > 0 || r.FormValue("removeParents") != ""
+	if moved {
+		s.touchParents(f)
+	}
+	if p := r.FormValue("removeParents"); p != "" {
+		remove := make(map[string]bool)
+		for _, id := range strings.Split(p, ",") {
+			remove[id] = true
+		}
+		var keep []*drive.ParentReference
+		for _, p := range c.Parents {
+			if !remove[p.Id] {
+				keep = append(keep, p)
+			}
+		}
+		c.Parents = keep
+	}
+	c.Parents = append(c.Parents, parentRefs(add)...)
+	if r.FormValue("setModifiedDate") != "true" {
+		c.ModifiedDate = now()
+	}
+	*f = c
+	if moved {
+		s.touchParents(f)
+	}
+	s.changes = append(s.changes, f.Id)
+	writeJSON(w, f)
+}
+
+// decodeOnto decodes a request into c, a copy of f, so that fields in the
+// request replace those of f. Lists are replaced, not merged, and f is not
+// changed.
+func decodeOnto(r io.Reader, c, f *drive.File) error {
+	c.Parents = nil
+	c.Properties = nil
+	if err := json.NewDecoder(r).Decode(c); err != nil && err != io.EOF {
+		return err
+	}
+	if c.Parents == nil {
+		for _, p := range f.Parents {
+			p := *p
+			c.Parents = append(c.Parents, &p)
+		}
+	}
+	if c.Properties == nil {
+		for _, p := range f.Properties {
+			p := *p
+			c.Properties = append(c.Properties, &p)
+		}
+	}
+	return nil
+}
+
+// copy handles Files.Copy. Fields in the request replace those of the
+// source, and the copy is owned by Me.
+func (s *Server) copy(w http.ResponseWriter, r *http.Request, f *drive.File) {
+	c := *f
+	c.Id = ""
+	c.Owners = nil
+	c.OwnerNames = nil
+	c.ModifiedDate = ""
+	c.Labels = &drive.FileLabels{}
+	if err := decodeOnto(r.Body, &c, f); err != nil {
+		writeError(w, http.StatusBadRequest, "parseError", fmt.Sprintf("parsing metadata: %v", err))
+		return
+	}
+	if _, ok := s.files[c.Id]; ok {
+		writeError(w, http.StatusConflict, "duplicate", fmt.Sprintf("A file already exists with the provided ID: %s", c.Id))
+		return
+	}
+	for _, p := range c.Parents {
+		if _, ok := s.files[p.Id]; !ok {
+			writeError(w, http.StatusNotFound, "notFound", fmt.Sprintf("File not found: %s", p.Id))
+			return
+		}
+	}
+	s.add(&c, s.content[f.Id])
+	writeJSON(w, &c)
+}
+
+// insertPerm handles Permissions.Insert. Inserting an owner transfers
+// ownership, and the old owners become writers, like in Drive.
+func (s *Server) insertPerm(w http.ResponseWriter, r *http.Request, f *drive.File) {
+	var p drive.Permission
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		writeError(w, http.StatusBadRequest, "parseError", fmt.Sprintf("parsing permission: %v", err))
+		return
+	}
+	n := s.newPerm(p.Type, p.Role, p.Value)
+	if p.Type == "domain" {
+		n.EmailAddress, n.Domain = "", p.Value
+	}
+	n.WithLink = p.WithLink
+	n.AdditionalRoles = p.AdditionalRoles
+	if p.Role == "owner" {
+		for _, o := range s.perms[f.Id] {
+			if o.Role == "owner" {
+				o.Role = "writer"
+			}
+		}
+		f.Owners = []*drive.User{{Kind: "drive#user", EmailAddress: p.Value, DisplayName: p.Value, IsAuthenticatedUser: p.Value == Me}}
+		f.OwnerNames = []string{p.Value}
+		s.changes = append(s.changes, f.Id)
+	}
+	s.perms[f.Id] = append(s.perms[f.Id], n)
+	writeJSON(w, n)
+}
+
+// insert handles Files.Insert, both metadata-only and multipart uploads.
+func (s *Server) insert(w http.ResponseWriter, r *http.Request) {
+	var meta io.Reader = r.Body
+	var content []byte
+	mt, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if strings.HasPrefix(mt, "multipart/") {
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		p, err := mr.NextPart()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "badRequest", fmt.Sprintf("reading metadata part: %v", err))
+			return
+		}
+		b, err := ioutil.ReadAll(p)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "badRequest", fmt.Sprintf("reading metadata part: %v", err))
+			return
+		}
+		meta = bytes.NewReader(b)
+		p, err = mr.NextPart()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "badRequest", fmt.Sprintf("reading media part: %v", err))
+			return
+		}
+		if content, err = ioutil.ReadAll(p); err != nil {
+			writeError(w, http.StatusBadRequest, "badRequest", fmt.Sprintf("reading media part: %v", err))
+			return
+		}
+	}
+	f := &drive.File{}
+	if err := json.NewDecoder(meta).Decode(f); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "parseError", fmt.Sprintf("parsing metadata: %v", err))
+		return
+	}
+	for _, p := range f.Parents {
+		if _, ok := s.files[p.Id]; !ok {
+			writeError(w, http.StatusNotFound, "notFound", fmt.Sprintf("File not found: %s", p.Id))
+			return
+		}
+	}
+	// Like Drive, IDs from GenerateIds can be used, but only once.
+	if _, ok := s.files[f.Id]; ok {
+		writeError(w, http.StatusConflict, "duplicate", fmt.Sprintf("A file already exists with the provided ID: %s", f.Id))
+		return
+	}
+	if r.URL.Query().Get("uploadType") == "resumable" {
+		// The content is sent later, in chunks.
+		s.nextID++
+		id := fmt.Sprintf("upload-%d", s.nextID)
+		s.uploads[id] = &upload{meta: f}
+		w.Header().Set("Location", fmt.Sprintf("https://%s/upload/drive/v2/files?uploadType=resumable&upload_id=%s", apiHost, id))
+		return
+	}
+	s.create(w, f, content)
+}
+
+// uploadChunk handles a chunk of a resumable upload. The file is created
+// when the last chunk arrives.
+func (s *Server) uploadChunk(w http.ResponseWriter, r *http.Request, id string) {
+	u, ok := s.uploads[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "notFound", fmt.Sprintf("Upload not found: %s", id))
+		return
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "badRequest", fmt.Sprintf("reading chunk: %v", err))
+		return
+	}
+	// "bytes first-last/total", "bytes first-last/*" or "bytes */total".
+	var first, total int
+	cr := r.Header.Get("Content-Range")
+	rng := strings.SplitN(strings.TrimPrefix(cr, "bytes "), "/", 2)
+	if len(rng) != 2 {
+		writeError(w, http.StatusBadRequest, "badContentRange", fmt.Sprintf("bad Content-Range %q", cr))
+		return
+	}
+	if rng[0] != "*" {
+		if _, err := fmt.Sscanf(rng[0], "%d-", &first); err != nil {
+			writeError(w, http.StatusBadRequest, "badContentRange", fmt.Sprintf("bad Content-Range %q", cr))
+			return
+		}
+	} else {
+		first = len(u.content)
+	}
+	if first > len(u.content) {
+		writeError(w, http.StatusBadRequest, "badContentRange", fmt.Sprintf("chunk at %d, but only got %d bytes", first, len(u.content)))
+		return
+	}
+	// A chunk sent again replaces what was received of it.
+	u.content = append(u.content[:first], b...)
+	if rng[1] != "*" {
+		if total, err = strconv.Atoi(rng[1]); err != nil {
+			writeError(w, http.StatusBadRequest, "badContentRange", fmt.Sprintf("bad Content-Range %q", cr))
+			return
+		}
+		if total == len(u.content) {
+			delete(s.uploads, id)
+			s.create(w, u.meta, u.content)
+			return
+		}
+	}
+	// Like Drive when asked not to send 308 Resume Incomplete.
+	if len(u.content) > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(u.content)-1))
+	}
+	w.Header().Set("X-Http-Status-Code-Override", "308")
+}
+
+// create creates a file inserted with Files.Insert.
+func (s *Server) create(w http.ResponseWriter, f *drive.File, content []byte) {
+	f.Owners = nil
+	f.OwnerNames = nil
+	if f.MimeType == "" {
+		f.MimeType = "application/octet-stream"
+	}
+	if content == nil && f.MimeType != folderMime {
+		content = []byte{}
+	}
+	s.add(f, content)
+	writeJSON(w, f)
+}
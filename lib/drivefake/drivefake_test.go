@@ -0,0 +1,313 @@
+package drivefake
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	drive "google.golang.org/api/drive/v2"
+	"google.golang.org/api/googleapi"
+)
+
+func TestGetAndList(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.PageSize = 2
+	s.AddFolder("root", "My Drive")
+	s.AddFolder("a", "a", "root")
+	s.AddFile("b", "b.txt", "hello", "root")
+	s.AddFile("c", "c.txt", "world", "root", "a")
+
+	d := s.Service()
+	f, err := d.Files.Get("b").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.FileSize, int64(5); got != want {
+		t.Errorf("FileSize: got %d, want %d", got, want)
+	}
+
+	var ids []string
+	token := ""
+	for {
+		l, err := d.Children.List("root").PageToken(token).Do()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range l.Items {
+			ids = append(ids, c.Id)
+		}
+		if token = l.NextPageToken; token == "" {
+			break
+		}
+	}
+	if got, want := len(ids), 3; got != want {
+		t.Errorf("root children: got %v, want %d entries", ids, want)
+	}
+	if got, want := s.Children("a"), []string{"c"}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("a children: got %v, want %v", got, want)
+	}
+}
+
+func TestInsertDownloadTrash(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.AddFolder("root", "My Drive")
+	d := s.Service()
+
+	f, err := d.Files.Insert(&drive.File{
+		Title:   "new.txt",
+		Parents: []*drive.ParentReference{{Id: "root"}},
+	}).Media(bytes.NewBufferString("some content")).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(s.Content(f.Id)), "some content"; got != want {
+		t.Errorf("content: got %q, want %q", got, want)
+	}
+
+	resp, err := d.Files.Get(f.Id).Download()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	buf.ReadFrom(resp.Body)
+	resp.Body.Close()
+	if got, want := buf.String(), "some content"; got != want {
+		t.Errorf("download: got %q, want %q", got, want)
+	}
+
+	if _, err := d.Files.Trash(f.Id).Do(); err != nil {
+		t.Fatal(err)
+	}
+	if !s.File(f.Id).Labels.Trashed {
+		t.Errorf("file not trashed")
+	}
+	if _, err := d.Files.Untrash(f.Id).Do(); err != nil {
+		t.Fatal(err)
+	}
+	if s.File(f.Id).Labels.Trashed {
+		t.Errorf("file not untrashed")
+	}
+}
+
+func TestResumableUpload(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.AddFolder("root", "My Drive")
+	d := s.Service()
+	content := strings.Repeat("0123456789", 100000)
+
+	// A chunk fails once, and is sent again.
+	s.Inject(Fault{Op: "Files.Upload", Code: 503, Reason: "backendError", Times: 1})
+	var progress []int64
+	f, err := d.Files.Insert(&drive.File{
+		Title:   "big.txt",
+		Parents: []*drive.ParentReference{{Id: "root"}},
+	}).Media(strings.NewReader(content), googleapi.ChunkSize(googleapi.MinUploadChunkSize)).
+		ProgressUpdater(func(cur, _ int64) { progress = append(progress, cur) }).
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(s.Content(f.Id)); got != content {
+		t.Errorf("content: got %d bytes, want %d", len(got), len(content))
+	}
+	if got, want := s.Calls("Files.Upload"), 5; got != want {
+		t.Errorf("got %d chunks sent, want %d", got, want)
+	}
+	if got, want := len(progress), 4; got != want || progress[len(progress)-1] != int64(len(content)) {
+		t.Errorf("progress: got %v, want %d updates ending with %d", progress, want, len(content))
+	}
+
+	req, err := http.NewRequest("GET", f.DownloadUrl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=999990-")
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent || string(b) != "0123456789" {
+		t.Errorf("range download: got %d %q, want 206 %q", resp.StatusCode, b, "0123456789")
+	}
+}
+
+func TestGenerateIds(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.AddFolder("root", "My Drive")
+	d := s.Service()
+
+	ids, err := d.Files.GenerateIds().MaxResults(2).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(ids.Ids), 2; got != want {
+		t.Fatalf("got %d IDs, want %d", got, want)
+	}
+	f := &drive.File{Id: ids.Ids[0], Title: "x", Parents: []*drive.ParentReference{{Id: "root"}}}
+	if g, err := d.Files.Insert(f).Do(); err != nil {
+		t.Fatal(err)
+	} else if g.Id != ids.Ids[0] {
+		t.Errorf("ID: got %q, want %q", g.Id, ids.Ids[0])
+	}
+	if _, err := d.Files.Insert(f).Do(); err == nil {
+		t.Errorf("want error reusing ID")
+	}
+}
+
+func TestCopy(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.AddFolder("root", "My Drive")
+	s.AddFolder("a", "a", "root")
+	s.Add(&drive.File{
+		Id:          "doc",
+		Title:       "doc",
+		MimeType:    "application/vnd.google-apps.document",
+		Description: "desc",
+		Owners:      []*drive.User{{EmailAddress: "other@example.com"}},
+		Parents:     []*drive.ParentReference{{Id: "root"}},
+	}, nil)
+	s.AddFile("f", "f", "content", "root")
+	d := s.Service()
+
+	c, err := d.Files.Copy("doc", &drive.File{Title: "copy", Parents: []*drive.ParentReference{{Id: "a"}}}).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = s.File(c.Id)
+	if c.Title != "copy" || c.Description != "desc" || c.MimeType != "application/vnd.google-apps.document" {
+		t.Errorf("copy: got %+v", c)
+	}
+	if got, want := c.Owners[0].EmailAddress, Me; got != want {
+		t.Errorf("owner: got %q, want %q", got, want)
+	}
+	if got, want := strings.Join(s.Children("a"), ","), c.Id; got != want {
+		t.Errorf("children of a: got %q, want %q", got, want)
+	}
+	c, err = d.Files.Copy("f", &drive.File{Id: "f2"}).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(s.Content("f2")), "content"; got != want {
+		t.Errorf("content: got %q, want %q", got, want)
+	}
+}
+
+func TestTransferOwnership(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.Add(&drive.File{Id: "f", Title: "f", Owners: []*drive.User{{EmailAddress: "old@example.com"}}}, []byte("x"))
+	d := s.Service()
+
+	about, err := d.About.Get().Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Permissions.Insert("f", &drive.Permission{Type: "user", Role: "owner", Value: about.User.EmailAddress}).Do(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.File("f").Owners[0].EmailAddress, Me; got != want {
+		t.Errorf("owner: got %q, want %q", got, want)
+	}
+	var got []string
+	for _, p := range s.Permissions("f") {
+		got = append(got, p.EmailAddress+":"+p.Role)
+	}
+	if want := "old@example.com:writer," + Me + ":owner"; strings.Join(got, ",") != want {
+		t.Errorf("permissions: got %q, want %q", got, want)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.AddFolder("root", "My Drive")
+	s.AddFolder("a", "a", "root")
+	s.AddFile("f", "f", "x", "root")
+	d := s.Service()
+
+	if _, err := d.Files.Patch("f", &drive.File{Labels: &drive.FileLabels{Starred: true}}).Do(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Files.Patch("f", &drive.File{}).AddParents("a").RemoveParents("root").Do(); err != nil {
+		t.Fatal(err)
+	}
+	f := s.File("f")
+	if !f.Labels.Starred {
+		t.Errorf("file not starred")
+	}
+	if got, want := f.Title, "f"; got != want {
+		t.Errorf("title: got %q, want %q", got, want)
+	}
+	if got, want := strings.Join(s.Children("a"), ","), "f"; got != want {
+		t.Errorf("children of a: got %q, want %q", got, want)
+	}
+	if got, want := strings.Join(s.Children("root"), ","), "a"; got != want {
+		t.Errorf("children of root: got %q, want %q", got, want)
+	}
+	if _, err := d.Files.Patch("f", &drive.File{}).AddParents("nonexistent").Do(); err == nil {
+		t.Errorf("want error moving to nonexistent folder")
+	}
+	const date = "2001-02-03T04:05:06.000Z"
+	if _, err := d.Files.Patch("f", &drive.File{ModifiedDate: date}).SetModifiedDate(true).Do(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.File("f").ModifiedDate, date; got != want {
+		t.Errorf("modifiedDate: got %q, want %q", got, want)
+	}
+}
+
+func TestListPermissions(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.AddFile("f", "f", "x")
+	s.AddPermission("f", "user", "reader", "a@example.com")
+	s.AddPermission("f", "domain", "reader", "example.com")
+	d := s.Service()
+
+	l, err := d.Permissions.List("f").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range l.Items {
+		got = append(got, p.Type+":"+p.Role+":"+p.EmailAddress+p.Domain)
+	}
+	if got, want := strings.Join(got, ","), "user:owner:"+Me+",user:reader:a@example.com,domain:reader:example.com"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestInject(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.AddFile("a", "a.txt", "a")
+	s.Inject(Fault{Op: "Files.Get", ID: "a", Code: 403, Reason: "userRateLimitExceeded", Times: 1})
+	d := s.Service()
+
+	_, err := d.Files.Get("a").Do()
+	e, ok := err.(*googleapi.Error)
+	if !ok {
+		t.Fatalf("want *googleapi.Error, got %v", err)
+	}
+	if got, want := e.Code, 403; got != want {
+		t.Errorf("code: got %d, want %d", got, want)
+	}
+	if got, want := e.Errors[0].Reason, "userRateLimitExceeded"; got != want {
+		t.Errorf("reason: got %q, want %q", got, want)
+	}
+	if _, err := d.Files.Get("a").Do(); err != nil {
+		t.Errorf("second call: %v", err)
+	}
+	if got, want := s.Calls("Files.Get"), 2; got != want {
+		t.Errorf("calls: got %d, want %d", got, want)
+	}
+}
@@ -5,97 +5,351 @@ package lib
  */
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
+	"strings"
 	"sync"
 	"time"
 
 	drive "google.golang.org/api/drive/v2"
+	"google.golang.org/api/googleapi"
 )
 
 const (
 	DriveFolder = "application/vnd.google-apps.folder"
-	backoffBase = 500 * time.Millisecond
-	backoff     = 1.5
-	maxBackoff  = 2 * time.Minute
+
+	// nativePrefix is the MIME type prefix of Google Docs, Sheets, Slides, etc.
+	nativePrefix = "application/vnd.google-apps."
+
+	backoff    = 1.5
+	maxBackoff = 2 * time.Minute
 )
 
 var (
 	Verbose = false
+
+	// backoffBase is the first delay between attempts, and maxRetries the
+	// most attempts made before giving up.
+	backoffBase = 500 * time.Millisecond
+	maxRetries  = 20
+
+	// ErrRetry can be returned from an ErrorHandler to retry the failed item.
+	ErrRetry = errors.New("retry")
 )
 
+// ListError is an error listing a single item during a recursive listing.
+type ListError struct {
+	Op   string   // API call that failed, e.g. "Files.List".
+	ID   string   // File or folder ID that failed.
+	Path []string // Path of the folder being processed.
+	Err  error
+}
+
+func (e *ListError) Error() string {
+	return fmt.Sprintf("%s(%s) in %q: %v", e.Op, e.ID, strings.Join(e.Path, "/"), e.Err)
+}
+
+// ErrorHandler decides what to do about a failed item. Return nil to skip
+// the item, ErrRetry to try it again after a backoff, or any other error to
+// abort the listing. An item that still fails after being retried too many
+// times aborts the listing.
+type ErrorHandler func(*ListError) error
+
+// ListOptions controls ListRecursiveContext.
+type ListOptions struct {
+	// Workers is the number of concurrent API workers. Defaults to 1.
+	Workers int
+
+	// OnError is called for every item that fails. If nil the listing is
+	// aborted on the first error.
+	OnError ErrorHandler
+
+	// Cache, if set, is used to skip listing folders that haven't changed
+	// since the last scan, and is updated with new listings.
+	Cache *Cache
+
+	// IncludeFolders sends folders on the channel too, not just files.
+	IncludeFolders bool
+
+	// IncludeTrashed includes trashed files and the contents of trashed
+	// folders.
+	IncludeTrashed bool
+}
+
+// ListRecursive lists all files under folder id, sending them on ch.
+// Any error is fatal. ch is closed when done.
 func ListRecursive(d *drive.Service, workers int, ch chan<- *File, id string) {
+	if err := ListRecursiveContext(context.Background(), d, ch, id, &ListOptions{Workers: workers}); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// ListRecursiveContext lists all files under folder id, sending them on ch.
+// ch is closed when done. Listing stops when ctx is cancelled or when
+// opts.OnError returns an error, and that error is returned.
+func ListRecursiveContext(ctx context.Context, d *drive.Service, ch chan<- *File, id string, opts *ListOptions) error {
 	defer close(ch)
-	work := newWork()
-	work.add(func() {
-		Find(d, work, ch, id, "", nil)
+	if opts == nil {
+		opts = &ListOptions{}
+	}
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := &walker{
+		ctx:     ctx,
+		cancel:  cancel,
+		d:       d,
+		work:    newWork(ctx),
+		ch:      ch,
+		onError: opts.OnError,
+		cache:   opts.Cache,
+		folders: opts.IncludeFolders,
+		trashed: opts.IncludeTrashed,
+	}
+	start := time.Now()
+	modified := ""
+	if w.cache != nil {
+		root, err := getFile(ctx, d, id, "id,modifiedDate")
+		if err != nil {
+			return &ListError{Op: "Files.Get", ID: id, Err: err}
+		}
+		modified = root.ModifiedDate
+		if last, ok := w.cache.scanned(id); ok {
+			cs, err := changes(ctx, d, last.Add(-cacheSkew))
+			if err != nil {
+				return &ListError{Op: "Files.List", ID: id, Err: err}
+			}
+			w.cache.apply(cs)
+			w.changed = cs.folders
+		}
+	}
+	w.work.add(func() {
+		w.find(id, "", nil, nil, modified)
 	})
 	for i := 0; i < workers; i++ {
 		go func() {
-			for work.get() {
+			for w.work.get() {
 			}
 		}()
 	}
-	work.wait()
+	w.work.wait()
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if w.cache != nil {
+		w.cache.setScanned(id, start)
+	}
+	return nil
 }
 
-func getFile(d *drive.Service, id string) (*drive.File, error) {
-	backoff := backoffBase
-	for {
+// sleep sleeps for duration d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// retryable returns true if err is worth retrying, such as rate limiting or
+// server errors.
+func retryable(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	if !ok {
+		// Network error or similar.
+		return true
+	}
+	switch {
+	case e.Code == 429, e.Code >= 500:
+		return true
+	case e.Code == 403:
+		for _, r := range e.Errors {
+			switch r.Reason {
+			case "rateLimitExceeded", "userRateLimitExceeded":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Backoff is the growing delay between attempts that Retry uses. The zero
+// value starts from the shortest delay.
+type Backoff struct {
+	delay time.Duration
+}
+
+// Wait sleeps before the next attempt, a little longer each time, or until
+// ctx is done.
+func (b *Backoff) Wait(ctx context.Context) error {
+	if b.delay == 0 {
+		b.delay = backoffBase
+	}
+	err := sleep(ctx, time.Duration((1.0+rand.Float64()/2.0)*float64(b.delay)))
+	b.delay = time.Duration(float64(b.delay) * backoff)
+	if b.delay > maxBackoff {
+		b.delay = maxBackoff
+	}
+	return err
+}
+
+// Reset starts again from the shortest delay, e.g. after an attempt
+// succeeded.
+func (b *Backoff) Reset() {
+	b.delay = 0
+}
+
+// Retry calls f until it succeeds, fails with a non-retryable error, fails
+// too many times, or ctx is done. Rate limiting, server and network errors
+// are retried with backoff.
+func Retry(ctx context.Context, op string, f func() error) error {
+	var b Backoff
+	for tries := 1; ; tries++ {
 		st := time.Now()
-		f, err := d.Files.Get(id).Do()
+		err := f()
 		if err == nil {
 			if Verbose {
-				log.Printf("Files.Get: %v", time.Since(st))
+				log.Printf("%s: %v", op, time.Since(st))
 			}
-			return f, nil
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
-		log.Printf("Failed Files.Get: %v\n", err)
-		time.Sleep(time.Duration((1.0 + rand.Float64()/2.0) * float64(backoff)))
-		backoff *= backoff
-		if backoff > maxBackoff {
-			backoff = maxBackoff
+		if !retryable(err) || tries >= maxRetries {
+			return err
+		}
+		log.Printf("Failed %s: %v\n", op, err)
+		if err := b.Wait(ctx); err != nil {
+			return err
 		}
 	}
 }
 
-func listDir(d *drive.Service, id, pageToken string) (*drive.ChildList, error) {
-	backoff := backoffBase
+// fileFields is the set of file fields fetched when listing, covering
+// everything du, find and chown use.
+const fileFields = "id,title,mimeType,fileSize,quotaBytesUsed,md5Checksum,owners,ownerNames," +
+	"labels,explicitlyTrashed,parents,createdDate,modifiedDate,description," +
+	"originalFilename,properties,downloadUrl,alternateLink,headRevisionId,shared"
+
+func getFile(ctx context.Context, d *drive.Service, id, fields string) (*drive.File, error) {
+	var f *drive.File
+	err := Retry(ctx, fmt.Sprintf("Files.Get(%s)", id), func() error {
+		var err error
+		f, err = d.Files.Get(id).Fields(googleapi.Field(fields)).Context(ctx).Do()
+		return err
+	})
+	return f, err
+}
+
+// changeSet is what changed since the last scan.
+type changeSet struct {
+	folders map[string]string      // modifiedDate of changed folders.
+	files   map[string]*drive.File // Changed and trashed files and folders.
+}
+
+// changes returns all files and folders modified since t, and all trashed
+// ones. Drive doesn't update a folder's modifiedDate when a file in it is
+// changed or trashed, so cached listings must be patched with these. Files
+// in the trash are always included, since trashing doesn't change the
+// modifiedDate either, and the trash is emptied after 30 days.
+func changes(ctx context.Context, d *drive.Service, t time.Time) (*changeSet, error) {
+	cs := &changeSet{
+		folders: make(map[string]string),
+		files:   make(map[string]*drive.File),
+	}
+	q := fmt.Sprintf("modifiedDate > '%s' or trashed = true", t.UTC().Format(time.RFC3339))
+	pageToken := ""
 	for {
-		st := time.Now()
-		l, err := d.Children.List(id).PageToken(pageToken).Do()
-		if err == nil {
-			if Verbose {
-				log.Printf("Children.List: %v", time.Since(st))
+		var l *drive.FileList
+		err := Retry(ctx, fmt.Sprintf("Files.List(%q, %q)", q, pageToken), func() error {
+			var err error
+			l, err = d.Files.List().
+				Q(q).
+				Fields(googleapi.Field("nextPageToken,items(" + fileFields + ")")).
+				MaxResults(1000).
+				PageToken(pageToken).
+				Context(ctx).
+				Do()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range l.Items {
+			cs.files[f.Id] = f
+			if f.MimeType == DriveFolder {
+				cs.folders[f.Id] = f.ModifiedDate
 			}
-			return l, nil
 		}
-		log.Printf("Failed Children.List(%s, %q): %v\n", id, pageToken, err)
-		time.Sleep(time.Duration((1.0 + rand.Float64()/2.0) * float64(backoff)))
-		backoff *= backoff
-		if backoff > maxBackoff {
-			backoff = maxBackoff
+		if pageToken = l.NextPageToken; pageToken == "" {
+			return cs, nil
 		}
 	}
 }
 
+// listDir lists one page of the files in folder id.
+func listDir(ctx context.Context, d *drive.Service, id, pageToken string) (*drive.FileList, error) {
+	var l *drive.FileList
+	err := Retry(ctx, fmt.Sprintf("Files.List(%s, %q)", id, pageToken), func() error {
+		var err error
+		l, err = d.Files.List().
+			Q(fmt.Sprintf("'%s' in parents", id)).
+			Fields(googleapi.Field("nextPageToken,items(" + fileFields + ")")).
+			MaxResults(1000).
+			PageToken(pageToken).
+			Context(ctx).
+			Do()
+		return err
+	})
+	return l, err
+}
+
 type work struct {
-	mutex sync.Mutex
-	cond  sync.Cond
-	work  []func()
-	out   int
-	done  <-chan bool
+	mutex     sync.Mutex
+	cond      sync.Cond
+	work      []func()
+	out       int
+	cancelled bool
 }
 
-func newWork() *work {
+// newWork creates a work queue that drops all queued work when ctx is done.
+func newWork(ctx context.Context) *work {
 	w := &work{}
 	w.cond.L = &w.mutex
+	go func() {
+		<-ctx.Done()
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+		w.cancelled = true
+		w.work = nil
+		w.cond.Broadcast()
+	}()
 	return w
 }
 
 func (w *work) add(f func()) {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
+	if w.cancelled {
+		return
+	}
 	w.work = append(w.work, f)
 	w.cond.Signal()
 }
@@ -134,42 +388,143 @@ func (w *work) wait() {
 	}
 }
 
-func Find(d *drive.Service, wg *work, ch chan<- *File, id, page string, path []string) {
+// walker holds the state of one recursive listing.
+type walker struct {
+	ctx     context.Context
+	cancel  func()
+	d       *drive.Service
+	work    *work
+	ch      chan<- *File
+	onError ErrorHandler
+	cache   *Cache
+	folders bool
+	trashed bool
+
+	// changed is the modifiedDate of folders changed since the last scan.
+	// If nil, cached listings are not trusted.
+	changed map[string]string
+
+	mutex sync.Mutex
+	err   error
+}
+
+// fail reports a failed item to the error handler, after tries attempts, and
+// returns true if it should be retried. Otherwise it's skipped, or the
+// listing is aborted.
+func (w *walker) fail(e *ListError, tries int) bool {
+	if w.ctx.Err() != nil {
+		// Errors caused by cancellation are not interesting.
+		return false
+	}
+	var err error = e
+	if w.onError != nil {
+		err = w.onError(e)
+	}
+	switch {
+	case err == nil:
+		return false
+	case err == ErrRetry && tries < maxRetries:
+		return true
+	case err == ErrRetry:
+		err = e
+	}
+	w.mutex.Lock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.mutex.Unlock()
+	w.cancel()
+	return false
+}
+
+func (w *walker) send(f *File) {
+	select {
+	case w.ch <- f:
+	case <-w.ctx.Done():
+	}
+}
+
+// find lists one page of folder id, queueing the next page and all subfolders.
+// path and ids are the titles and IDs of the folders down to it. modified is
+// the folder's current modifiedDate, or empty if not known.
+func (w *walker) find(id, page string, path, ids []string, modified string) {
+	if page == "" && w.cache != nil && w.changed != nil {
+		if m, ok := w.changed[id]; ok {
+			modified = m
+		}
+		if items, ok := w.cache.get(id, modified); ok {
+			w.process(items, path, ids, true)
+			return
+		}
+	}
+
 	//log.Printf("Processing folder: %s", id)
-	l, err := listDir(d, id, "")
-	if err != nil {
-		log.Fatal(err)
+	var l *drive.FileList
+	var b Backoff
+	for tries := 1; ; tries++ {
+		var err error
+		if l, err = listDir(w.ctx, w.d, id, page); err == nil {
+			break
+		}
+		if !w.fail(&ListError{Op: "Files.List", ID: id, Path: path, Err: err}, tries) {
+			return
+		}
+		if b.Wait(w.ctx) != nil {
+			return
+		}
+	}
+	if w.cache != nil {
+		w.cache.put(id, page, modified, l.Items, l.NextPageToken == "")
 	}
 	if l.NextPageToken != "" {
-		wg.add(func() {
-			Find(d, wg, ch, id, l.NextPageToken, path)
+		w.work.add(func() {
+			w.find(id, l.NextPageToken, path, ids, modified)
 		})
 	}
+	w.process(l.Items, path, ids, false)
+}
 
-	for _, child := range l.Items {
-		c := child
-		wg.add(func() {
-			//log.Printf("Looking at item %v", c.Id)
-			f, err := getFile(d, c.Id)
-			if err != nil {
-				log.Fatal(err)
-			}
-			if f.ExplicitlyTrashed {
-				return
+// process sends files and queues subfolders. If the items came from the
+// cache their modifiedDate may be stale, so subfolders rely on the
+// changed folder list instead.
+func (w *walker) process(items []*drive.File, path, ids []string, cached bool) {
+	for _, f := range items {
+		if f.ExplicitlyTrashed && !w.trashed {
+			continue
+		}
+		if f.MimeType == DriveFolder {
+			sub := append(append([]string(nil), path...), f.Title)
+			subIDs := append(append([]string(nil), ids...), f.Id)
+			c, m := f.Id, f.ModifiedDate
+			if cached {
+				m = ""
 			}
-			if f.MimeType == DriveFolder {
-				wg.add(func() { Find(d, wg, ch, c.Id, "", append(path, f.Title)) })
-			} else {
-				ch <- &File{
-					Path: path,
-					File: f,
-				}
+			w.work.add(func() { w.find(c, "", sub, subIDs, m) })
+			if w.folders {
+				w.send(&File{
+					Path:    path,
+					PathIDs: ids,
+					File:    f,
+				})
 			}
-		})
+		} else {
+			w.send(&File{
+				Path:    path,
+				PathIDs: ids,
+				File:    f,
+			})
+		}
 	}
 }
 
+// IsNative returns true if f is a Google-native document, such as a Doc,
+// Sheet or Slides presentation. These have no FileSize.
+func IsNative(f *drive.File) bool {
+	return strings.HasPrefix(f.MimeType, nativePrefix) && f.MimeType != DriveFolder
+}
+
 type File struct {
-	Path []string
-	File *drive.File
+	Path    []string
+	PathIDs []string // IDs of the folders in Path, which may share titles.
+	File    *drive.File
 }
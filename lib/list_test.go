@@ -0,0 +1,236 @@
+package lib
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ThomasHabets/drive-du/lib/drivefake"
+)
+
+// tree creates a fake with a small folder tree.
+func tree() *drivefake.Server {
+	s := drivefake.New()
+	s.AddFolder("root", "My Drive")
+	s.AddFolder("a", "a", "root")
+	s.AddFolder("b", "b", "a")
+	s.AddFile("f1", "f1", "1", "root")
+	s.AddFile("f2", "f2", "22", "a")
+	s.AddFile("f3", "f3", "333", "b")
+	return s
+}
+
+// collect lists id and returns the sorted paths of all files.
+func collect(ctx context.Context, s *drivefake.Server, id string, opts *ListOptions) ([]string, error) {
+	ch := make(chan *File)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- ListRecursiveContext(ctx, s.Service(), ch, id, opts)
+	}()
+	var ret []string
+	for f := range ch {
+		ret = append(ret, strings.Join(append(append([]string(nil), f.Path...), f.File.Title), "/"))
+	}
+	sort.Strings(ret)
+	return ret, <-errCh
+}
+
+func TestListPathIDs(t *testing.T) {
+	s := tree()
+	defer s.Close()
+	ch := make(chan *File)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- ListRecursiveContext(context.Background(), s.Service(), ch, "root", nil)
+	}()
+	var got []string
+	for f := range ch {
+		got = append(got, f.File.Id+":"+strings.Join(f.PathIDs, "/"))
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	if want := []string{"f1:", "f2:a", "f3:a/b"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestListRecursive(t *testing.T) {
+	s := tree()
+	defer s.Close()
+	got, err := collect(context.Background(), s, "root", &ListOptions{Workers: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a/b/f3", "a/f2", "f1"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// One list call per folder, and no per-file calls.
+	if got, want := s.Calls("Files.List"), 3; got != want {
+		t.Errorf("Files.List calls: got %d, want %d", got, want)
+	}
+	if got, want := s.Calls("Files.Get")+s.Calls("Children.List"), 0; got != want {
+		t.Errorf("Files.Get+Children.List calls: got %d, want %d", got, want)
+	}
+}
+
+func TestListRecursiveTrashed(t *testing.T) {
+	s := tree()
+	defer s.Close()
+	if _, err := s.Service().Files.Trash("b").Do(); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		trashed bool
+		want    []string
+	}{
+		{false, []string{"a/f2", "f1"}},
+		{true, []string{"a/b/f3", "a/f2", "f1"}},
+	} {
+		got, err := collect(context.Background(), s, "root", &ListOptions{IncludeTrashed: test.trashed})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("IncludeTrashed=%v: got %q, want %q", test.trashed, got, test.want)
+		}
+	}
+}
+
+func TestListRecursivePaging(t *testing.T) {
+	s := drivefake.New()
+	defer s.Close()
+	s.PageSize = 2
+	s.AddFolder("root", "My Drive")
+	s.AddFolder("a", "a", "root")
+	var want []string
+	for _, n := range []string{"1", "2", "3", "4", "5"} {
+		s.AddFile("r"+n, "r"+n, n, "root")
+		s.AddFile("a"+n, "a"+n, n, "a")
+		want = append(want, "a/a"+n, "r"+n)
+	}
+	sort.Strings(want)
+
+	got, err := collect(context.Background(), s, "root", &ListOptions{Workers: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// root has 6 entries and a has 5, so 3 pages each.
+	if got, want := s.Calls("Files.List"), 6; got != want {
+		t.Errorf("Files.List calls: got %d, want %d", got, want)
+	}
+}
+
+func TestListRecursiveSkip(t *testing.T) {
+	s := tree()
+	defer s.Close()
+	s.Inject(drivefake.Fault{Op: "Files.List", ID: "b", Code: 404, Times: -1})
+	var errs []*ListError
+	got, err := collect(context.Background(), s, "root", &ListOptions{
+		OnError: func(e *ListError) error {
+			errs = append(errs, e)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a/f2", "f1"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("got %d errors, want 1", len(errs))
+	}
+	if got, want := errs[0].ID, "b"; got != want {
+		t.Errorf("error ID: got %q, want %q", got, want)
+	}
+	if got, want := strings.Join(errs[0].Path, "/"), "a/b"; got != want {
+		t.Errorf("error path: got %q, want %q", got, want)
+	}
+}
+
+func TestListRecursiveAbort(t *testing.T) {
+	s := tree()
+	defer s.Close()
+	s.Inject(drivefake.Fault{Op: "Files.List", ID: "a", Code: 404, Times: -1})
+	_, err := collect(context.Background(), s, "root", nil)
+	e, ok := err.(*ListError)
+	if !ok {
+		t.Fatalf("want *ListError, got %v", err)
+	}
+	if got, want := e.ID, "a"; got != want {
+		t.Errorf("error ID: got %q, want %q", got, want)
+	}
+}
+
+func TestListRecursiveRetry(t *testing.T) {
+	s := tree()
+	defer s.Close()
+	// Retryable errors are retried by backoff, without the handler seeing them.
+	s.Inject(drivefake.Fault{Op: "Files.List", ID: "root", Code: 500, Times: 1})
+	// Non-retryable errors can be retried by the handler.
+	s.Inject(drivefake.Fault{Op: "Files.List", ID: "a", Code: 404, Times: 1})
+	handled := 0
+	got, err := collect(context.Background(), s, "root", &ListOptions{
+		OnError: func(e *ListError) error {
+			handled++
+			return ErrRetry
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a/b/f3", "a/f2", "f1"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if handled != 1 {
+		t.Errorf("handler called %d times, want 1", handled)
+	}
+}
+
+func TestListRecursiveRetryLimit(t *testing.T) {
+	oldBase, oldMax := backoffBase, maxRetries
+	backoffBase, maxRetries = time.Millisecond, 3
+	defer func() { backoffBase, maxRetries = oldBase, oldMax }()
+
+	for _, test := range []struct {
+		code    int
+		handled int
+	}{
+		{500, 3}, // Retried by backoff each time the handler retries.
+		{404, 3},
+	} {
+		s := tree()
+		s.Inject(drivefake.Fault{Op: "Files.List", ID: "a", Code: test.code, Times: -1})
+		handled := 0
+		_, err := collect(context.Background(), s, "root", &ListOptions{
+			OnError: func(e *ListError) error {
+				handled++
+				return ErrRetry
+			},
+		})
+		s.Close()
+		if _, ok := err.(*ListError); !ok {
+			t.Errorf("%d: got error %v, want a ListError", test.code, err)
+		}
+		if handled != test.handled {
+			t.Errorf("%d: handler called %d times, want %d", test.code, handled, test.handled)
+		}
+	}
+}
+
+func TestListRecursiveCancel(t *testing.T) {
+	s := tree()
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := collect(ctx, s, "root", nil); err != context.Canceled {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
@@ -6,7 +6,10 @@ package lib
 
 import (
 	"fmt"
+	"math"
 	"regexp"
+	"strconv"
+	"strings"
 )
 
 var (
@@ -23,3 +26,65 @@ func Pretty(n int64) string {
 		ret = n
 	}
 }
+
+// Units selects how sizes are formatted.
+type Units int
+
+const (
+	UnitsBytes  Units = iota // Exact byte count with thousands separators.
+	UnitsBinary              // Powers of 1024: KiB, MiB, GiB, ...
+	UnitsSI                  // Powers of 1000: kB, MB, GB, ...
+)
+
+var (
+	binaryUnits = []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	siUnits     = []string{"B", "kB", "MB", "GB", "TB", "PB", "EB"}
+)
+
+// HumanSize formats n bytes in the given units, with precision digits
+// after the decimal point. Sizes below one kilobyte are always exact.
+func HumanSize(n int64, u Units, precision int) string {
+	var base float64
+	var names []string
+	switch u {
+	case UnitsBinary:
+		base, names = 1024, binaryUnits
+	case UnitsSI:
+		base, names = 1000, siUnits
+	default:
+		return Pretty(n)
+	}
+	sign := ""
+	f := float64(n)
+	if f < 0 {
+		sign, f = "-", -f
+	}
+	if f < base {
+		return fmt.Sprintf("%s%d %s", sign, int64(f), names[0])
+	}
+	i := 0
+	for f >= base && i < len(names)-1 {
+		f /= base
+		i++
+	}
+	return fmt.Sprintf("%s%s %s", sign, strconv.FormatFloat(f, 'f', precision, 64), names[i])
+}
+
+var sizeRE = regexp.MustCompile(`(?i)^(\d+(?:\.\d+)?)\s*([kmgt]?)(?:i?b)?$`)
+
+// ParseSize parses a size like "1500", "64K", "10M" or "1.5GiB". Suffixes
+// are powers of 1024.
+func ParseSize(s string) (int64, error) {
+	m := sizeRE.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	f, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad size %q: %v", s, err)
+	}
+	if m[2] != "" {
+		f *= math.Pow(1024, float64(strings.Index("kmgt", strings.ToLower(m[2]))+1))
+	}
+	return int64(f), nil
+}
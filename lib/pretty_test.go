@@ -17,3 +17,58 @@ func TestPretty(t *testing.T) {
 		}
 	}
 }
+
+func TestHumanSize(t *testing.T) {
+	for _, test := range []struct {
+		n         int64
+		units     Units
+		precision int
+		want      string
+	}{
+		{1234, UnitsBytes, 1, "1,234"},
+		{0, UnitsBinary, 1, "0 B"},
+		{1023, UnitsBinary, 1, "1023 B"},
+		{1024, UnitsBinary, 1, "1.0 KiB"},
+		{1536, UnitsBinary, 2, "1.50 KiB"},
+		{5 << 30, UnitsBinary, 0, "5 GiB"},
+		{999, UnitsSI, 1, "999 B"},
+		{1000, UnitsSI, 1, "1.0 kB"},
+		{1234567, UnitsSI, 3, "1.235 MB"},
+		{-1500, UnitsSI, 1, "-1.5 kB"},
+		{1 << 62, UnitsBinary, 1, "4.0 EiB"},
+	} {
+		if got := HumanSize(test.n, test.units, test.precision); got != test.want {
+			t.Errorf("HumanSize(%d, %d, %d): got %q, want %q", test.n, test.units, test.precision, got, test.want)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for _, test := range []struct {
+		s    string
+		want int64
+	}{
+		{"0", 0},
+		{"1500", 1500},
+		{"64K", 64 << 10},
+		{"64k", 64 << 10},
+		{"10M", 10 << 20},
+		{"1.5GiB", 3 << 29},
+		{"2 TB", 2 << 40},
+		{"100b", 100},
+	} {
+		got, err := ParseSize(test.s)
+		if err != nil {
+			t.Errorf("ParseSize(%q): %v", test.s, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseSize(%q): got %d, want %d", test.s, got, test.want)
+		}
+	}
+	for _, s := range []string{"", "M", "-1", "10X", "1.2.3"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("ParseSize(%q): want error", s)
+		}
+	}
+}
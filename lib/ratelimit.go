@@ -0,0 +1,167 @@
+package lib
+
+/*
+ * This file contains rate limiting of requests and bandwidth, to stay
+ * inside API quotas.
+ */
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// limitChunk is the most bytes read from a body at a time, so that a
+// bandwidth limit is applied smoothly.
+const limitChunk = 32 << 10
+
+// Limiter is a token bucket. Tokens are added at a fixed rate, up to a
+// burst, and taken by Wait. A nil Limiter never waits.
+type Limiter struct {
+	mutex  sync.Mutex
+	rate   float64 // Tokens per second.
+	burst  float64 // Most tokens saved up.
+	tokens float64 // Negative when waiters have taken more than there is.
+	last   time.Time
+}
+
+// NewLimiter creates a Limiter adding rate tokens per second, up to burst.
+// It returns nil, which is unlimited, if rate is not positive.
+func NewLimiter(rate, burst float64) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &Limiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Wait takes n tokens, waiting until they're available or ctx is done. n
+// may be more than the burst, in which case it waits for the rest.
+func (l *Limiter) Wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	// Taking them now makes later callers wait behind this one.
+	l.tokens -= float64(n)
+	d := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mutex.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	return sleep(ctx, d)
+}
+
+// Limits limits the requests per second and bytes per second of all clients
+// made by Client, together.
+type Limits struct {
+	qps *Limiter
+	bw  *Limiter
+}
+
+// NewLimits creates Limits of qps requests per second and bw bytes per
+// second, uploaded and downloaded. Zero is unlimited.
+func NewLimits(qps float64, bw int64) *Limits {
+	l := &Limits{}
+	if qps > 0 {
+		burst := qps
+		if burst < 1 {
+			burst = 1
+		}
+		l.qps = NewLimiter(qps, burst)
+	}
+	if bw > 0 {
+		burst := float64(bw)
+		if burst < limitChunk {
+			burst = limitChunk
+		}
+		l.bw = NewLimiter(float64(bw), burst)
+	}
+	return l
+}
+
+// ParseLimits creates Limits from flags, where bwlimit is a size per second
+// like "10M", or empty for unlimited.
+func ParseLimits(qps float64, bwlimit string) (*Limits, error) {
+	var bw int64
+	if bwlimit != "" {
+		var err error
+		if bw, err = ParseSize(bwlimit); err != nil {
+			return nil, err
+		}
+	}
+	return NewLimits(qps, bw), nil
+}
+
+// Client returns a client making requests with c, within the limits.
+func (l *Limits) Client(c *http.Client) *http.Client {
+	if l.qps == nil && l.bw == nil {
+		return c
+	}
+	rt := c.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	ret := *c
+	ret.Transport = &limitTransport{rt: rt, l: l}
+	return &ret
+}
+
+type limitTransport struct {
+	rt http.RoundTripper
+	l  *Limits
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if err := t.l.qps.Wait(ctx, 1); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	if t.l.bw != nil && req.Body != nil {
+		// Requests must not be changed, so send a copy.
+		req = req.WithContext(ctx)
+		req.Body = &limitBody{ctx: ctx, rc: req.Body, l: t.l.bw}
+	}
+	resp, err := t.rt.RoundTrip(req)
+	if err == nil && t.l.bw != nil {
+		resp.Body = &limitBody{ctx: ctx, rc: resp.Body, l: t.l.bw}
+	}
+	return resp, err
+}
+
+// limitBody is a request or response body read within a bandwidth limit.
+type limitBody struct {
+	ctx context.Context
+	rc  io.ReadCloser
+	l   *Limiter
+}
+
+func (b *limitBody) Read(p []byte) (int, error) {
+	if len(p) > limitChunk {
+		p = p[:limitChunk]
+	}
+	n, err := b.rc.Read(p)
+	if werr := b.l.Wait(b.ctx, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+func (b *limitBody) Close() error {
+	return b.rc.Close()
+}
@@ -0,0 +1,96 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	drive "google.golang.org/api/drive/v2"
+
+	"github.com/ThomasHabets/drive-du/lib/drivefake"
+)
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	var nilLimiter *Limiter
+	if err := nilLimiter.Wait(ctx, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	// The burst is free, the rest wait for the rate.
+	l := NewLimiter(100, 10)
+	st := time.Now()
+	for i := 0; i < 30; i++ {
+		if err := l.Wait(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(st); d < 180*time.Millisecond || d > time.Second {
+		t.Errorf("30 tokens at 100/s with burst 10 took %v, want about 200ms", d)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := NewLimiter(1, 1).Wait(ctx, 10); err != context.Canceled {
+		t.Errorf("cancelled: got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestLimitsClient(t *testing.T) {
+	s := drivefake.New()
+	defer s.Close()
+	s.AddFolder("root", "My Drive")
+	for i := 0; i < 15; i++ {
+		id := fmt.Sprintf("d%d", i)
+		s.AddFolder(id, id, "root")
+	}
+	content := strings.Repeat("x", 600<<10)
+	s.AddFile("f", "f", content, "root")
+
+	// All workers share the limit: 16 listings at 10/s with a burst of 10.
+	d, err := drive.New(NewLimits(10, 0).Client(s.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := time.Now()
+	ch := make(chan *File)
+	go func() {
+		for range ch {
+		}
+	}()
+	if err := ListRecursiveContext(context.Background(), d, ch, "root", &ListOptions{Workers: 8}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.Calls("Children.List")+s.Calls("Files.List"), 16; got != want {
+		t.Errorf("got %d listings, want %d", got, want)
+	}
+	if dur := time.Since(st); dur < 500*time.Millisecond {
+		t.Errorf("listing took %v, want about 600ms", dur)
+	}
+
+	// 600 KiB at 400 KiB/s, with a burst of one second.
+	c := NewLimits(0, 400<<10).Client(s.Client())
+	st = time.Now()
+	resp, err := c.Get(s.File("f").DownloadUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != len(content) {
+		t.Errorf("got %d bytes, want %d", len(b), len(content))
+	}
+	if dur := time.Since(st); dur < 400*time.Millisecond || dur > 2*time.Second {
+		t.Errorf("download took %v, want about 500ms", dur)
+	}
+
+	if _, ok := NewLimits(0, 0).Client(s.Client()).Transport.(*limitTransport); ok {
+		t.Errorf("no limits: got a limited transport")
+	}
+}
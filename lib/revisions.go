@@ -0,0 +1,97 @@
+package lib
+
+/*
+ * This file contains revision history accounting.
+ */
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	drive "google.golang.org/api/drive/v2"
+)
+
+// OldRevisionsSize returns the total size of all revisions of f except the
+// current one. Drive counts them against quota, but not in FileSize.
+func OldRevisionsSize(ctx context.Context, d *drive.Service, f *drive.File) (int64, error) {
+	var revs []*drive.Revision
+	pageToken := ""
+	for {
+		var l *drive.RevisionList
+		err := Retry(ctx, fmt.Sprintf("Revisions.List(%s)", f.Id), func() error {
+			var err error
+			l, err = d.Revisions.List(f.Id).
+				PageToken(pageToken).
+				Fields("nextPageToken,items(id,fileSize)").
+				Context(ctx).
+				Do()
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		revs = append(revs, l.Items...)
+		if pageToken = l.NextPageToken; pageToken == "" {
+			break
+		}
+	}
+
+	// Revisions are listed oldest first, so the head is last unless told
+	// otherwise.
+	head := f.HeadRevisionId
+	if head == "" && len(revs) > 0 {
+		head = revs[len(revs)-1].Id
+	}
+	var ret int64
+	for _, r := range revs {
+		if r.Id != head {
+			ret += r.FileSize
+		}
+	}
+	return ret, nil
+}
+
+// RevisionSizes calls OldRevisionsSize for every file, using workers
+// concurrent calls. Files whose revisions can't be listed, usually because
+// the user can't edit them, are logged and left out of the result.
+func RevisionSizes(ctx context.Context, d *drive.Service, files []*File, workers int) (map[*File]int64, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	ret := make(map[*File]int64)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	ch := make(chan *File)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range ch {
+				n, err := OldRevisionsSize(ctx, d, f.File)
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Printf("Failed to list revisions of %q (%s): %v", f.File.Title, f.File.Id, err)
+					}
+					continue
+				}
+				mutex.Lock()
+				ret[f] = n
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, f := range files {
+		select {
+		case ch <- f:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(ch)
+	wg.Wait()
+	return ret, ctx.Err()
+}
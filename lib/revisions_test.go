@@ -0,0 +1,42 @@
+package lib
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ThomasHabets/drive-du/lib/drivefake"
+)
+
+func TestRevisionSizes(t *testing.T) {
+	s := tree()
+	defer s.Close()
+	s.PageSize = 2
+	s.AddRevision("f3", "1")
+	s.AddRevision("f3", "22")
+	s.AddRevision("f3", "4444")
+	s.Inject(drivefake.Fault{Op: "Revisions.List", ID: "f2", Code: 403, Reason: "insufficientFilePermissions", Times: -1})
+
+	var files []*File
+	for _, id := range []string{"f1", "f2", "f3"} {
+		files = append(files, &File{File: s.File(id)})
+	}
+	got, err := RevisionSizes(context.Background(), s.Service(), files, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, want := range []int64{0, -1, 7} {
+		v, ok := got[files[n]]
+		if want < 0 {
+			if ok {
+				t.Errorf("%s: got %d, want no result", files[n].File.Id, v)
+			}
+			continue
+		}
+		if v != want {
+			t.Errorf("%s: got %d, want %d", files[n].File.Id, v, want)
+		}
+	}
+	if got, want := s.File("f3").QuotaBytesUsed, int64(10); got != want {
+		t.Errorf("quotaBytesUsed: got %d, want %d", got, want)
+	}
+}
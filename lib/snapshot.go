@@ -0,0 +1,233 @@
+package lib
+
+/*
+ * This file contains local snapshots of a folder tree, kept up to date with
+ * the Drive changes feed.
+ */
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	drive "google.golang.org/api/drive/v2"
+)
+
+const changeFields = "nextPageToken,newStartPageToken,items(fileId,deleted,file(" + fileFields + "))"
+
+// Snapshot is a local copy of the metadata of everything under a folder.
+//
+// Create one with NewSnapshot, and bring it up to date with Update instead
+// of listing the whole tree again.
+type Snapshot struct {
+	Folder string                 // Folder ID as given, e.g. "root".
+	Root   string                 // Resolved ID of Folder.
+	Token  string                 // Changes page token to continue from.
+	Files  map[string]*drive.File // All files and folders under Root, by ID.
+}
+
+// NewSnapshot lists folder id recursively and returns a snapshot of it.
+func NewSnapshot(ctx context.Context, d *drive.Service, id string, opts *ListOptions) (*Snapshot, error) {
+	// Get the token first, so that changes made while listing are not lost.
+	var token *drive.StartPageToken
+	if err := Retry(ctx, "Changes.GetStartPageToken", func() error {
+		var err error
+		token, err = d.Changes.GetStartPageToken().Context(ctx).Do()
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	root, err := getFile(ctx, d, id, "id")
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{
+		Folder: id,
+		Root:   root.Id,
+		Token:  token.StartPageToken,
+		Files:  make(map[string]*drive.File),
+	}
+	if err := s.add(ctx, d, root.Id, opts); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// LoadSnapshot reads a snapshot saved with Save.
+func LoadSnapshot(fn string) (*Snapshot, error) {
+	s := &Snapshot{}
+	if err := loadGob(fn, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Save writes the snapshot, including the changes token, to disk.
+func (s *Snapshot) Save(fn string) error {
+	return saveGob(fn, s)
+}
+
+// add lists folder id recursively and adds everything to the snapshot.
+func (s *Snapshot) add(ctx context.Context, d *drive.Service, id string, opts *ListOptions) error {
+	o := ListOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	o.IncludeFolders = true
+	ch := make(chan *File)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- ListRecursiveContext(ctx, d, ch, id, &o)
+	}()
+	for f := range ch {
+		s.Files[f.File.Id] = f.File
+	}
+	return <-errCh
+}
+
+// Update fetches all changes since the last update and applies them.
+// Folders that appear in the tree without being in the changes feed, such
+// as folders moved in from elsewhere, are listed recursively.
+func (s *Snapshot) Update(ctx context.Context, d *drive.Service, opts *ListOptions) error {
+	var changes []*drive.Change
+	token := s.Token
+	for {
+		var l *drive.ChangeList
+		if err := Retry(ctx, fmt.Sprintf("Changes.List(%q)", token), func() error {
+			var err error
+			l, err = d.Changes.List().
+				PageToken(token).
+				IncludeDeleted(true).
+				Fields(changeFields).
+				MaxResults(1000).
+				Context(ctx).
+				Do()
+			return err
+		}); err != nil {
+			return err
+		}
+		changes = append(changes, l.Items...)
+		if l.NewStartPageToken != "" {
+			token = l.NewStartPageToken
+			break
+		}
+		token = l.NextPageToken
+	}
+
+	before := make(map[string]bool)
+	for id := range s.Files {
+		before[id] = true
+	}
+	s.Apply(changes)
+	var added []string
+	for id, f := range s.Files {
+		if f.MimeType == DriveFolder && !before[id] {
+			added = append(added, id)
+		}
+	}
+	for _, id := range added {
+		if err := s.add(ctx, d, id, opts); err != nil {
+			return err
+		}
+	}
+	s.Token = token
+	return nil
+}
+
+// Apply applies changes to the snapshot. Afterwards anything not under the
+// root folder is dropped, since the changes feed covers the whole drive.
+func (s *Snapshot) Apply(changes []*drive.Change) {
+	for _, c := range changes {
+		if c.Deleted || c.File == nil {
+			delete(s.Files, c.FileId)
+			continue
+		}
+		s.Files[c.FileId] = c.File
+	}
+
+	// Drop everything no longer reachable from the root.
+	reachable := make(map[string]bool)
+	children := s.children()
+	var walk func(id string)
+	walk = func(id string) {
+		for _, f := range children[id] {
+			if !reachable[f.Id] {
+				reachable[f.Id] = true
+				walk(f.Id)
+			}
+		}
+	}
+	walk(s.Root)
+	for id := range s.Files {
+		if !reachable[id] {
+			delete(s.Files, id)
+		}
+	}
+}
+
+// children returns all files in the snapshot by parent ID.
+func (s *Snapshot) children() map[string][]*drive.File {
+	ret := make(map[string][]*drive.File)
+	for _, f := range s.Files {
+		for _, p := range f.Parents {
+			ret[p.Id] = append(ret[p.Id], f)
+		}
+	}
+	return ret
+}
+
+// List sends all files in the snapshot on ch, the same way
+// ListRecursiveContext would. ch is closed when done.
+func (s *Snapshot) List(ctx context.Context, ch chan<- *File, opts *ListOptions) error {
+	defer close(ch)
+	folders := opts != nil && opts.IncludeFolders
+	trashed := opts != nil && opts.IncludeTrashed
+	children := s.children()
+	var walk func(id string, path, ids []string) error
+	walk = func(id string, path, ids []string) error {
+		for _, f := range children[id] {
+			if f.ExplicitlyTrashed && !trashed {
+				continue
+			}
+			isFolder := f.MimeType == DriveFolder
+			if !isFolder || folders {
+				select {
+				case ch <- &File{Path: path, PathIDs: ids, File: f}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			if isFolder {
+				if err := walk(f.Id, append(append([]string(nil), path...), f.Title), append(append([]string(nil), ids...), f.Id)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return walk(s.Root, nil, nil)
+}
+
+// ListSnapshot lists folder id using the snapshot file fn. If fn exists it's
+// updated from the changes feed, otherwise a new snapshot is created. The
+// snapshot is saved before files are sent on ch. ch is closed when done.
+func ListSnapshot(ctx context.Context, d *drive.Service, ch chan<- *File, id, fn string, opts *ListOptions) error {
+	s, err := LoadSnapshot(fn)
+	switch {
+	case os.IsNotExist(err):
+		s, err = NewSnapshot(ctx, d, id, opts)
+	case err != nil:
+	case s.Folder != id:
+		err = fmt.Errorf("snapshot %q is of folder %q, not %q", fn, s.Folder, id)
+	default:
+		err = s.Update(ctx, d, opts)
+	}
+	if err == nil {
+		err = s.Save(fn)
+	}
+	if err != nil {
+		close(ch)
+		return err
+	}
+	return s.List(ctx, ch, opts)
+}
@@ -0,0 +1,122 @@
+package lib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	drive "google.golang.org/api/drive/v2"
+)
+
+// paths returns the sorted paths of all files in a snapshot.
+func paths(t *testing.T, s *Snapshot) []string {
+	ch := make(chan *File)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.List(context.Background(), ch, nil)
+	}()
+	var ret []string
+	for f := range ch {
+		ret = append(ret, strings.Join(append(append([]string(nil), f.Path...), f.File.Title), "/"))
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drive-du-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "snapshot")
+
+	s := tree()
+	defer s.Close()
+	s.AddFolder("other", "other")
+	s.AddFolder("x", "x", "other")
+	s.AddFile("fx", "fx", "x", "x")
+	d := s.Service()
+
+	snap, err := NewSnapshot(context.Background(), d, "root", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := paths(t, snap), []string{"a/b/f3", "a/f2", "f1"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("new: got %q, want %q", got, want)
+	}
+	if err := snap.Save(fn); err != nil {
+		t.Fatal(err)
+	}
+
+	s.AddFile("f4", "f4", "4444", "b")
+	s.Move("b", "root")
+	s.Delete("f2")
+	s.Move("x", "a")
+	if _, err := d.Files.Trash("f1").Do(); err != nil {
+		t.Fatal(err)
+	}
+	s.Add(&drive.File{Id: "elsewhere", Title: "elsewhere"}, []byte("x"))
+
+	snap, err = LoadSnapshot(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := s.Calls("Files.List")
+	if err := snap.Update(context.Background(), d, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := paths(t, snap), []string{"a/x/fx", "b/f3", "b/f4"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("updated: got %q, want %q", got, want)
+	}
+	// Only the folder moved in from outside needs to be listed.
+	if got, want := s.Calls("Files.List")-before, 1; got != want {
+		t.Errorf("Files.List calls: got %d, want %d", got, want)
+	}
+	if _, ok := snap.Files["elsewhere"]; ok {
+		t.Errorf("file outside the tree was added to the snapshot")
+	}
+
+	// No more changes.
+	if err := snap.Update(context.Background(), d, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.Calls("Files.List")-before, 1; got != want {
+		t.Errorf("Files.List calls after second update: got %d, want %d", got, want)
+	}
+}
+
+func TestListSnapshotWrongFolder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drive-du-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "snapshot")
+
+	s := tree()
+	defer s.Close()
+	for _, id := range []string{"root", "a"} {
+		ch := make(chan *File)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- ListSnapshot(context.Background(), s.Service(), ch, id, fn, nil)
+		}()
+		for range ch {
+		}
+		err := <-errCh
+		if id == "root" && err != nil {
+			t.Fatal(err)
+		}
+		if id == "a" && err == nil {
+			t.Errorf("want error using snapshot of another folder")
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package lib
+
+/*
+ * This file contains a folder tree with cumulative sizes, for du-style output.
+ */
+
+import (
+	"sort"
+)
+
+// Tree is a folder or file with the cumulative size and file count of
+// everything under it. Children are keyed by Drive ID, since folders often
+// have several children with the same name.
+type Tree struct {
+	Name     string
+	ID       string // Drive ID, if known.
+	Folder   bool
+	Size     int64 // Total size of all files under this folder.
+	Files    int64 // Total number of files under this folder.
+	Native   int64 // Number of Google-native documents, not counted in Size.
+	Revs     int64 // Total size of old revisions of all files under this folder.
+	Children map[string]*Tree
+}
+
+// NewTree creates an empty tree.
+func NewTree(name string) *Tree {
+	return &Tree{
+		Name:     name,
+		Folder:   true,
+		Children: make(map[string]*Tree),
+	}
+}
+
+// treeKey returns the key of a child, which is its ID if known.
+func treeKey(name, id string) string {
+	if id == "" {
+		return name
+	}
+	return id
+}
+
+// child returns the subfolder with the given name and ID, creating it if
+// needed.
+func (t *Tree) child(name, id string) *Tree {
+	k := treeKey(name, id)
+	c, ok := t.Children[k]
+	if !ok {
+		c = NewTree(name)
+		c.ID = id
+		t.Children[k] = c
+	}
+	return c
+}
+
+// folders returns the folders down to the one with titles path and IDs ids,
+// creating them if needed. ids may be shorter than path if not known.
+func (t *Tree) folders(path, ids []string) []*Tree {
+	ret := []*Tree{t}
+	for i, p := range path {
+		id := ""
+		if i < len(ids) {
+			id = ids[i]
+		}
+		t = t.child(p, id)
+		ret = append(ret, t)
+	}
+	return ret
+}
+
+// AddFolder adds a folder in the folder with titles path and IDs ids, so
+// that it's included even if it's empty.
+func (t *Tree) AddFolder(path, ids []string, name, id string) {
+	fs := t.folders(path, ids)
+	fs[len(fs)-1].child(name, id)
+}
+
+// Add adds a file in the folder with titles path and IDs ids, adding its size
+// to every folder above it. A file added twice to the same folder is counted
+// as one entry.
+func (t *Tree) Add(path, ids []string, name, id string, size int64) {
+	t.add(path, ids, name, id, size, 0)
+}
+
+// AddNative adds a Google-native document, whose size is not known.
+func (t *Tree) AddNative(path, ids []string, name, id string) {
+	t.add(path, ids, name, id, 0, 1)
+}
+
+func (t *Tree) add(path, ids []string, name, id string, size, native int64) {
+	fs := t.folders(path, ids)
+	for _, n := range fs {
+		n.Size += size
+		n.Files++
+		n.Native += native
+	}
+	n := fs[len(fs)-1]
+	k := treeKey(name, id)
+	f, ok := n.Children[k]
+	if !ok {
+		f = &Tree{Name: name, ID: id}
+		n.Children[k] = f
+	}
+	f.Size += size
+	f.Files++
+	f.Native += native
+}
+
+// AddRevisions adds the size of old revisions of an already added file to it
+// and every folder above it.
+func (t *Tree) AddRevisions(path, ids []string, name, id string, size int64) {
+	fs := t.folders(path, ids)
+	for _, n := range fs {
+		n.Revs += size
+	}
+	if f, ok := fs[len(fs)-1].Children[treeKey(name, id)]; ok {
+		f.Revs += size
+	}
+}
+
+// Walk calls fn for t and everything under it, children before parents and
+// sorted by name, like du(1). Children with the same name are reported
+// separately, sorted by ID. Folders deeper than maxDepth are not
+// reported, but still counted. A negative maxDepth means no limit. Files are
+// reported only if files is true.
+func (t *Tree) Walk(maxDepth int, files bool, fn func(path []string, t *Tree)) {
+	t.walk(nil, maxDepth, files, fn)
+}
+
+func (t *Tree) walk(path []string, maxDepth int, files bool, fn func(path []string, t *Tree)) {
+	if maxDepth < 0 || len(path) < maxDepth {
+		var cs []*Tree
+		for _, c := range t.Children {
+			if c.Folder || files {
+				cs = append(cs, c)
+			}
+		}
+		sort.Slice(cs, func(i, j int) bool {
+			if cs[i].Name != cs[j].Name {
+				return cs[i].Name < cs[j].Name
+			}
+			return cs[i].ID < cs[j].ID
+		})
+		for _, c := range cs {
+			c.walk(append(append([]string(nil), path...), c.Name), maxDepth, files, fn)
+		}
+	}
+	fn(path, t)
+}
@@ -0,0 +1,71 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestTree(t *testing.T) {
+	tree := NewTree(".")
+	tree.Add(nil, nil, "f1", "1", 1)
+	tree.Add([]string{"a"}, []string{"A"}, "f2", "2", 20)
+	tree.Add([]string{"a", "b"}, []string{"A", "B"}, "f3", "3", 300)
+	tree.Add([]string{"a", "b"}, []string{"A", "B"}, "f4", "4", 4000)
+	tree.AddFolder([]string{"a"}, []string{"A"}, "empty", "e")
+
+	for _, test := range []struct {
+		depth int
+		files bool
+		want  []string
+	}{
+		{-1, false, []string{"a/b 4300 2", "a/empty 0 0", "a 4320 3", " 4321 4"}},
+		{0, false, []string{" 4321 4"}},
+		{1, false, []string{"a 4320 3", " 4321 4"}},
+		{1, true, []string{"a 4320 3", "f1 1 1", " 4321 4"}},
+		{-1, true, []string{"a/b/f3 300 1", "a/b/f4 4000 1", "a/b 4300 2", "a/empty 0 0", "a/f2 20 1", "a 4320 3", "f1 1 1", " 4321 4"}},
+	} {
+		var got []string
+		tree.Walk(test.depth, test.files, func(path []string, n *Tree) {
+			got = append(got, fmt.Sprintf("%s %d %d", strings.Join(path, "/"), n.Size, n.Files))
+		})
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("Walk(%d, %v): got %q, want %q", test.depth, test.files, got, test.want)
+		}
+	}
+	tree.AddNative([]string{"a", "b"}, []string{"A", "B"}, "doc", "5")
+	if got, want := tree.Native, int64(1); got != want {
+		t.Errorf("root native: got %d, want %d", got, want)
+	}
+	if got, want := tree.Children["A"].Children["B"].Native, int64(1); got != want {
+		t.Errorf("a/b native: got %d, want %d", got, want)
+	}
+	if got, want := tree.Children["A"].Children["B"].Size, int64(4300); got != want {
+		t.Errorf("a/b size: got %d, want %d", got, want)
+	}
+	tree.AddRevisions([]string{"a", "b"}, []string{"A", "B"}, "f3", "3", 30)
+	if got, want := tree.Children["A"].Revs, int64(30); got != want {
+		t.Errorf("a revisions: got %d, want %d", got, want)
+	}
+	if got, want := tree.Children["A"].Children["B"].Children["3"].Revs, int64(30); got != want {
+		t.Errorf("a/b/f3 revisions: got %d, want %d", got, want)
+	}
+	if got, want := tree.Children["A"].Children["e"].ID, "e"; got != want {
+		t.Errorf("folder ID: got %q, want %q", got, want)
+	}
+
+	// Folders and files with the same name are kept apart.
+	tree = NewTree(".")
+	tree.AddFolder(nil, nil, "a", "A1")
+	tree.AddFolder(nil, nil, "a", "A2")
+	tree.Add([]string{"a"}, []string{"A1"}, "f", "1", 1)
+	tree.Add([]string{"a"}, []string{"A2"}, "f", "2", 20)
+	tree.Add([]string{"a"}, []string{"A2"}, "f", "3", 300)
+	var got []string
+	tree.Walk(-1, true, func(path []string, n *Tree) {
+		got = append(got, fmt.Sprintf("%s %s %d", strings.Join(path, "/"), n.ID, n.Size))
+	})
+	if want := []string{"a/f 1 1", "a A1 1", "a/f 2 20", "a/f 3 300", "a A2 320", "  321"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("same names: got %q, want %q", got, want)
+	}
+}